@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// jsonLog writes the access log and the request errors as JSON lines.
+var jsonLog = log.New(os.Stdout, "", 0)
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route"`
+	Respack   string    `json:"respack,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"durationMs"`
+	ClientIP  string    `json:"clientIp"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+type errorLogEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	RequestID string    `json:"requestId,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error"`
+	Stack     string    `json:"stack,omitempty"`
+}
+
+func writeJSONLog(v any) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Println("log -", err)
+		return
+	}
+	jsonLog.Println(string(line))
+}
+
+// logRequestError logs an error that can't be reported to the client anymore,
+// e.g. because the response has already been started.
+func logRequestError(r *http.Request, err error) {
+	writeJSONLog(&errorLogEntry{
+		Time:      time.Now(),
+		Level:     "error",
+		RequestID: requestID(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Error:     err.Error(),
+	})
+}
+
+// parseIPNets parses a list of IP addresses and CIDR ranges.
+func parseIPNets(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the address of the client. X-Forwarded-For is only
+// followed through trusted proxies, starting from the closest one.
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !containsIP(trusted, ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// clientIP returns the client address resolved by the request context
+// middleware.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
+
+// requestScheme returns the URL scheme the client used.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(schemeContextKey).(string); ok {
+		return scheme
+	}
+	return "http"
+}
+
+// requestContext assigns a request ID, echoed in the response, and resolves
+// the client address and scheme. The request ID and X-Forwarded-Proto of
+// trusted proxies are kept.
+func requestContext(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			fromProxy := containsIP(trusted, host)
+			id := r.Header.Get(requestIDHeader)
+			if id == "" || len(id) > 64 || !fromProxy {
+				id = newRequestID()
+			}
+			scheme := "http"
+			if r.TLS != nil || (fromProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+				scheme = "https"
+			}
+			w.Header().Set(requestIDHeader, id)
+			ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+			ctx = context.WithValue(ctx, clientIPContextKey, resolveClientIP(r, trusted))
+			ctx = context.WithValue(ctx, schemeContextKey, scheme)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// accessLog writes a JSON line for each request.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		entry := &accessLogEntry{
+			Time:      start,
+			RequestID: requestID(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Route:     routePattern(r),
+			Status:    rec.Status(),
+			Bytes:     rec.bytes,
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			ClientIP:  clientIP(r),
+			UserAgent: r.UserAgent(),
+		}
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			entry.Respack = rctx.URLParam("respack")
+			if entry.Respack == "" {
+				entry.Respack = rctx.URLParam("respacks")
+			}
+		}
+		writeJSONLog(entry)
+	})
+}
+
+// recoverPanics logs the panics of the handlers with their stack trace and
+// responds with 500 if nothing has been written yet.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			writeJSONLog(&errorLogEntry{
+				Time:      time.Now(),
+				Level:     "panic",
+				RequestID: requestID(r),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Error:     fmt.Sprint(v),
+				Stack:     string(debug.Stack()),
+			})
+			if rec.status == 0 {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -280,7 +280,7 @@ window.HuesUI = (function() {
       var modernUI = new HuesUIModern(Hues)
 
       Promise.all([respack, canvas])
-      .then(function() { modernUI.setupUI(this.root) }.bind(this))
+      .then(function() { if (!options.hideUI) { modernUI.setupUI(this.root) } }.bind(this))
       .then(function() { window.HuesEffect.renderFrame(); })
       .then(this.setupEffectHandlers.bind(this))
       .then(this.setupKeyHandlers.bind(this))
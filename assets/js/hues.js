@@ -818,7 +818,7 @@
   gainNode.connect(audioCtx.destination);
 
   var muted = false;
-  if (localStorage.getItem('Hues.muted') === "true") {
+  if (localStorage.getItem('Hues.muted') === "true" || window.huesConfig.muted) {
     muted = true;
   }
   var savedGain = parseFloat(localStorage.getItem('Hues.gain'));
@@ -1013,7 +1013,7 @@
 
   var loadRespackSongLoop = function(respack, song) {
     return new Promise(function(resolve, reject) {
-      var uri = respack["uri"] + "/" + encodeURIComponent(song["loop"]);
+      var uri = song["uri"] || respack["uri"] + "/" + encodeURIComponent(song["loop"]);
       loadRespackSongTrack(uri)
       .catch(function() {
         reject(Error("Could not find any supported audio track formats for " + song["loop"]));
@@ -1032,7 +1032,7 @@
         return;
       }
 
-      var uri = respack["uri"] + "/" + encodeURIComponent(song["buildup"]);
+      var uri = song["buildupUri"] || respack["uri"] + "/" + encodeURIComponent(song["buildup"]);
       loadRespackSongTrack(uri)
       .catch(function() {
         reject(Error("Could not find any supported audio track formats for " + song["buildup"] + " buildup"));
@@ -1443,14 +1443,25 @@
           respackPromises.push(loadRespack(respacks[i]));
         }
 
+        /* A respack whose hues replace the hues of all other respacks */
+        var optHues = options.hues;
+        if (typeof(optHues) !== 'undefined') {
+          console.log("Loading hues from respack " + optHues);
+          respackPromises.push(loadRespack(optHues));
+        }
+
         var setupPromise = Promise.all(respackPromises)
         .then(function(respacks) {
           var builtin = respacks.shift();
+          var huesRespack = null;
+          if (typeof(optHues) !== 'undefined') {
+            huesRespack = respacks.pop();
+          }
 
           var haveHues = false;
           for (var i = 0; i < respacks.length; i++) {
             var respack = respacks[i];
-            if (respack.hues) {
+            if (respack.hues && !huesRespack) {
               addHues(respack.name);
               haveHues = true;
             }
@@ -1462,12 +1473,17 @@
             }
           }
 
-          if (!haveHues) {
+          if (huesRespack) {
+            addHues(huesRespack.name);
+          } else if (!haveHues) {
             addHues(builtin.name);
           }
           console.log("Loaded hues:");
           console.log(self["hues"]);
           var hue = options.hue;
+          if (typeof(hue) === 'undefined') {
+            hue = options.defaultHue;
+          }
           if (typeof(hue) === 'undefined') {
             hue = 0x40 - 1;
           }
@@ -1481,6 +1497,9 @@
           console.log(self["songs"]);
           /* Preset the selected song */
           var song = options.song;
+          if (typeof(song) === 'undefined') {
+            song = options.defaultSong;
+          }
           if (typeof(song) === 'undefined') {
             song = 0;
           }
@@ -1491,6 +1510,9 @@
           console.log(self["images"]);
           /* Preset the selected image */
           var image = options.image;
+          if (typeof(image) === 'undefined') {
+            image = options.defaultImage;
+          }
           if (typeof(image) === 'undefined') {
             image = 0;
           }
@@ -0,0 +1,44 @@
+// Selection of individual songs and images for custom mixes.
+// Items are stored as "respack/name" strings and survive page reloads.
+document.addEventListener("alpine:init", () => {
+  Alpine.store("mix", {
+    songs: Alpine.$persist([]).as("mix-songs"),
+    images: Alpine.$persist([]).as("mix-images"),
+
+    has(kind, item) {
+      return this[kind].includes(item);
+    },
+
+    toggle(kind, item) {
+      if (this.has(kind, item)) {
+        this[kind] = this[kind].filter((i) => i !== item);
+      } else {
+        this[kind] = this[kind].concat([item]);
+      }
+    },
+
+    count() {
+      return this.songs.length + this.images.length;
+    },
+
+    clear() {
+      this.songs = [];
+      this.images = [];
+    },
+
+    params() {
+      const params = new URLSearchParams();
+      this.songs.forEach((item) => params.append("songs", item));
+      this.images.forEach((item) => params.append("images", item));
+      return params.toString();
+    },
+
+    url() {
+      return "mix/?" + this.params();
+    },
+
+    playlistUrl(format) {
+      return "mix/playlist." + format + "?" + this.params();
+    },
+  });
+});
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// oggTailSize is how much of the end of an Ogg stream is searched for
+	// the last page, which is at most 64 KiB long.
+	oggTailSize = 65307
+	// mp3SyncLimit is how far after the ID3 tag the first MP3 frame is
+	// looked for.
+	mp3SyncLimit = 64 << 10
+)
+
+// zipAudioDuration returns the duration of an audio file of a respack, or 0
+// if it can't be found without decoding. Ogg streams need their last page,
+// so they are only measured if they are stored uncompressed.
+func zipAudioDuration(archive io.ReaderAt, f *zip.File) time.Duration {
+	if f == nil {
+		return 0
+	}
+	switch strings.ToLower(filepath.Ext(f.Name)) {
+	case ".ogg", ".opus":
+		if f.Method != zip.Store {
+			return 0
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return 0
+		}
+		d, _ := oggDuration(io.NewSectionReader(archive, offset, int64(f.UncompressedSize64)))
+		return d
+	case ".mp3":
+		rc, err := f.Open()
+		if err != nil {
+			return 0
+		}
+		defer rc.Close()
+		d, _ := mp3Duration(rc, int64(f.UncompressedSize64))
+		return d
+	default:
+		return 0
+	}
+}
+
+// readFullAt reads len(p) bytes at the offset.
+func readFullAt(r io.ReaderAt, p []byte, offset int64) error {
+	n, err := r.ReadAt(p, offset)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// oggDuration reads the sample rate from the first page of an Ogg Vorbis or
+// Opus stream and the granule position from its last page.
+func oggDuration(r *io.SectionReader) (time.Duration, bool) {
+	var header [27]byte
+	if err := readFullAt(r, header[:], 0); err != nil || string(header[:4]) != "OggS" {
+		return 0, false
+	}
+	segments := make([]byte, header[26])
+	if err := readFullAt(r, segments, int64(len(header))); err != nil {
+		return 0, false
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	if size > 32 {
+		size = 32 // enough for the identification headers
+	}
+	body := make([]byte, size)
+	if err := readFullAt(r, body, int64(len(header)+len(segments))); err != nil {
+		return 0, false
+	}
+	var rate, preSkip int64
+	switch {
+	case bytes.HasPrefix(body, []byte("OpusHead")) && len(body) >= 12:
+		rate, preSkip = 48000, int64(binary.LittleEndian.Uint16(body[10:]))
+	case bytes.HasPrefix(body, []byte("\x01vorbis")) && len(body) >= 16:
+		rate = int64(binary.LittleEndian.Uint32(body[12:]))
+	default:
+		return 0, false
+	}
+	serial := binary.LittleEndian.Uint32(header[14:])
+
+	tailSize := r.Size()
+	if tailSize > oggTailSize {
+		tailSize = oggTailSize
+	}
+	tail := make([]byte, tailSize)
+	if err := readFullAt(r, tail, r.Size()-tailSize); err != nil {
+		return 0, false
+	}
+	granule := int64(-1)
+	for i := len(tail) - len(header); i >= 0 && granule < 0; i-- {
+		page := tail[i:]
+		if string(page[:4]) != "OggS" || page[4] != 0 || binary.LittleEndian.Uint32(page[14:]) != serial {
+			continue
+		}
+		// pages where no packet ends have a granule position of -1
+		granule = int64(binary.LittleEndian.Uint64(page[6:]))
+	}
+	if rate <= 0 || granule < preSkip {
+		return 0, false
+	}
+	return time.Duration((granule - preSkip) * int64(time.Second) / rate), true
+}
+
+var (
+	mp3Bitrates = [2][3][15]int{ // kbit/s by MPEG-1 or not, layer and index
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000} // of MPEG-1
+)
+
+// mp3Frame is what the duration is computed from in the first frame header.
+type mp3Frame struct {
+	bitrate    int // bit/s
+	sampleRate int
+	samples    int // per frame
+	sideInfo   int // size of the Layer III side information after the header
+}
+
+func parseMP3Header(h []byte) (mp3Frame, bool) {
+	if h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, false
+	}
+	version := h[1] >> 3 & 3 // 0: MPEG-2.5, 2: MPEG-2, 3: MPEG-1
+	layer := 4 - int(h[1]>>1&3)
+	bitrateIndex, rateIndex := int(h[2]>>4), int(h[2]>>2&3)
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	mpeg1 := version == 3
+	mono := h[3]>>6 == 3
+	frame := mp3Frame{sampleRate: mp3SampleRates[rateIndex]}
+	table := 1
+	if mpeg1 {
+		table = 0
+	} else if version == 2 {
+		frame.sampleRate /= 2
+	} else {
+		frame.sampleRate /= 4
+	}
+	frame.bitrate = mp3Bitrates[table][layer-1][bitrateIndex] * 1000
+	switch {
+	case layer == 1:
+		frame.samples = 384
+	case layer == 2 || mpeg1:
+		frame.samples = 1152
+	default:
+		frame.samples = 576
+	}
+	if layer == 3 {
+		switch {
+		case mpeg1 && mono:
+			frame.sideInfo = 17
+		case mpeg1:
+			frame.sideInfo = 32
+		case mono:
+			frame.sideInfo = 9
+		default:
+			frame.sideInfo = 17
+		}
+	}
+	return frame, true
+}
+
+// mp3Duration finds the first frame of an MP3 file after its ID3v2 tag. The
+// frame count of a Xing, Info or VBRI header gives the duration; without
+// one the file is taken to have a constant bitrate.
+func mp3Duration(r io.Reader, size int64) (time.Duration, bool) {
+	br := bufio.NewReader(r)
+	offset := int64(0)
+	if h, err := br.Peek(10); err == nil && string(h[:3]) == "ID3" {
+		tagSize := int(h[6]&0x7f)<<21 | int(h[7]&0x7f)<<14 | int(h[8]&0x7f)<<7 | int(h[9]&0x7f) + 10
+		if h[5]&0x10 != 0 {
+			tagSize += 10 // footer
+		}
+		if _, err := br.Discard(tagSize); err != nil {
+			return 0, false
+		}
+		offset += int64(tagSize)
+	}
+	var frame mp3Frame
+	for skipped := 0; ; skipped++ {
+		h, err := br.Peek(4)
+		if err != nil || skipped > mp3SyncLimit {
+			return 0, false
+		}
+		var ok bool
+		if frame, ok = parseMP3Header(h); ok {
+			break
+		}
+		br.Discard(1)
+		offset++
+	}
+	// the first frame is long enough for the headers, but the file may not be
+	var h [64]byte
+	head, _ := br.Peek(len(h))
+	copy(h[:], head)
+	frames := 0
+	if xing := h[4+frame.sideInfo:]; (string(xing[:4]) == "Xing" || string(xing[:4]) == "Info") &&
+		binary.BigEndian.Uint32(xing[4:])&1 != 0 {
+		frames = int(binary.BigEndian.Uint32(xing[8:]))
+	} else if vbri := h[4+32:]; string(vbri[:4]) == "VBRI" {
+		frames = int(binary.BigEndian.Uint32(vbri[14:]))
+	}
+	if frames > 0 {
+		return time.Duration(int64(frames) * int64(frame.samples) * int64(time.Second) / int64(frame.sampleRate)), true
+	}
+	if size <= offset {
+		return 0, false
+	}
+	return time.Duration(float64(size-offset) * 8 / float64(frame.bitrate) * float64(time.Second)), true
+}
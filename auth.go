@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+)
+
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+func (auth *BasicAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(auth.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="0x40 Hues"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin rejects cross-site posts, which browsers send with the Basic
+// Auth credentials on their own. Requests without Origin and Sec-Fetch-Site
+// headers don't come from a browser and are allowed.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		site := r.Header.Get("Sec-Fetch-Site")
+		crossSite := site != "" && site != "same-origin" && site != "none"
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			crossSite = crossSite || err != nil || u.Host != r.Host
+		}
+		if crossSite {
+			http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
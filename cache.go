@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryCache keeps the most recently generated values, up to its size.
+type memoryCache[V any] struct {
+	mtx     sync.Mutex
+	size    int
+	entries map[string]V
+	order   []string
+}
+
+func newMemoryCache[V any](size int) *memoryCache[V] {
+	return &memoryCache[V]{size: size, entries: make(map[string]V)}
+}
+
+func (c *memoryCache[V]) Get(key string) (V, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+func (c *memoryCache[V]) Add(key string, value V) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = value
+	c.order = append(c.order, key)
+}
+
+// respacksCacheKey identifies what is generated from the respacks. It
+// changes when a respack file is replaced.
+func respacksCacheKey(respacks []*Respack) string {
+	keys := make([]string, len(respacks))
+	for i, respack := range respacks {
+		keys[i] = respack.ID + "@" + strconv.FormatInt(respack.ModTime().Unix(), 10)
+	}
+	return strings.Join(keys, ",")
+}
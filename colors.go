@@ -0,0 +1,259 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// namedColors are the CSS named colors, without the duplicate grey
+// spellings.
+var namedColors = []struct {
+	Name  string
+	Color uint32
+}{
+	{"AliceBlue", 0xf0f8ff},
+	{"AntiqueWhite", 0xfaebd7},
+	{"Aqua", 0x00ffff},
+	{"Aquamarine", 0x7fffd4},
+	{"Azure", 0xf0ffff},
+	{"Beige", 0xf5f5dc},
+	{"Bisque", 0xffe4c4},
+	{"Black", 0x000000},
+	{"BlanchedAlmond", 0xffebcd},
+	{"Blue", 0x0000ff},
+	{"BlueViolet", 0x8a2be2},
+	{"Brown", 0xa52a2a},
+	{"BurlyWood", 0xdeb887},
+	{"CadetBlue", 0x5f9ea0},
+	{"Chartreuse", 0x7fff00},
+	{"Chocolate", 0xd2691e},
+	{"Coral", 0xff7f50},
+	{"CornflowerBlue", 0x6495ed},
+	{"Cornsilk", 0xfff8dc},
+	{"Crimson", 0xdc143c},
+	{"Cyan", 0x00ffff},
+	{"DarkBlue", 0x00008b},
+	{"DarkCyan", 0x008b8b},
+	{"DarkGoldenrod", 0xb8860b},
+	{"DarkGray", 0xa9a9a9},
+	{"DarkGreen", 0x006400},
+	{"DarkKhaki", 0xbdb76b},
+	{"DarkMagenta", 0x8b008b},
+	{"DarkOliveGreen", 0x556b2f},
+	{"DarkOrange", 0xff8c00},
+	{"DarkOrchid", 0x9932cc},
+	{"DarkRed", 0x8b0000},
+	{"DarkSalmon", 0xe9967a},
+	{"DarkSeaGreen", 0x8fbc8f},
+	{"DarkSlateBlue", 0x483d8b},
+	{"DarkSlateGray", 0x2f4f4f},
+	{"DarkTurquoise", 0x00ced1},
+	{"DarkViolet", 0x9400d3},
+	{"DeepPink", 0xff1493},
+	{"DeepSkyBlue", 0x00bfff},
+	{"DimGray", 0x696969},
+	{"DodgerBlue", 0x1e90ff},
+	{"FireBrick", 0xb22222},
+	{"FloralWhite", 0xfffaf0},
+	{"ForestGreen", 0x228b22},
+	{"Fuchsia", 0xff00ff},
+	{"Gainsboro", 0xdcdcdc},
+	{"GhostWhite", 0xf8f8ff},
+	{"Gold", 0xffd700},
+	{"Goldenrod", 0xdaa520},
+	{"Gray", 0x808080},
+	{"Green", 0x008000},
+	{"GreenYellow", 0xadff2f},
+	{"Honeydew", 0xf0fff0},
+	{"HotPink", 0xff69b4},
+	{"IndianRed", 0xcd5c5c},
+	{"Indigo", 0x4b0082},
+	{"Ivory", 0xfffff0},
+	{"Khaki", 0xf0e68c},
+	{"Lavender", 0xe6e6fa},
+	{"LavenderBlush", 0xfff0f5},
+	{"LawnGreen", 0x7cfc00},
+	{"LemonChiffon", 0xfffacd},
+	{"LightBlue", 0xadd8e6},
+	{"LightCoral", 0xf08080},
+	{"LightCyan", 0xe0ffff},
+	{"LightGoldenrodYellow", 0xfafad2},
+	{"LightGray", 0xd3d3d3},
+	{"LightGreen", 0x90ee90},
+	{"LightPink", 0xffb6c1},
+	{"LightSalmon", 0xffa07a},
+	{"LightSeaGreen", 0x20b2aa},
+	{"LightSkyBlue", 0x87cefa},
+	{"LightSlateGray", 0x778899},
+	{"LightSteelBlue", 0xb0c4de},
+	{"LightYellow", 0xffffe0},
+	{"Lime", 0x00ff00},
+	{"LimeGreen", 0x32cd32},
+	{"Linen", 0xfaf0e6},
+	{"Magenta", 0xff00ff},
+	{"Maroon", 0x800000},
+	{"MediumAquamarine", 0x66cdaa},
+	{"MediumBlue", 0x0000cd},
+	{"MediumOrchid", 0xba55d3},
+	{"MediumPurple", 0x9370db},
+	{"MediumSeaGreen", 0x3cb371},
+	{"MediumSlateBlue", 0x7b68ee},
+	{"MediumSpringGreen", 0x00fa9a},
+	{"MediumTurquoise", 0x48d1cc},
+	{"MediumVioletRed", 0xc71585},
+	{"MidnightBlue", 0x191970},
+	{"MintCream", 0xf5fffa},
+	{"MistyRose", 0xffe4e1},
+	{"Moccasin", 0xffe4b5},
+	{"NavajoWhite", 0xffdead},
+	{"Navy", 0x000080},
+	{"OldLace", 0xfdf5e6},
+	{"Olive", 0x808000},
+	{"OliveDrab", 0x6b8e23},
+	{"Orange", 0xffa500},
+	{"OrangeRed", 0xff4500},
+	{"Orchid", 0xda70d6},
+	{"PaleGoldenrod", 0xeee8aa},
+	{"PaleGreen", 0x98fb98},
+	{"PaleTurquoise", 0xafeeee},
+	{"PaleVioletRed", 0xdb7093},
+	{"PapayaWhip", 0xffefd5},
+	{"PeachPuff", 0xffdab9},
+	{"Peru", 0xcd853f},
+	{"Pink", 0xffc0cb},
+	{"Plum", 0xdda0dd},
+	{"PowderBlue", 0xb0e0e6},
+	{"Purple", 0x800080},
+	{"RebeccaPurple", 0x663399},
+	{"Red", 0xff0000},
+	{"RosyBrown", 0xbc8f8f},
+	{"RoyalBlue", 0x4169e1},
+	{"SaddleBrown", 0x8b4513},
+	{"Salmon", 0xfa8072},
+	{"SandyBrown", 0xf4a460},
+	{"SeaGreen", 0x2e8b57},
+	{"Seashell", 0xfff5ee},
+	{"Sienna", 0xa0522d},
+	{"Silver", 0xc0c0c0},
+	{"SkyBlue", 0x87ceeb},
+	{"SlateBlue", 0x6a5acd},
+	{"SlateGray", 0x708090},
+	{"Snow", 0xfffafa},
+	{"SpringGreen", 0x00ff7f},
+	{"SteelBlue", 0x4682b4},
+	{"Tan", 0xd2b48c},
+	{"Teal", 0x008080},
+	{"Thistle", 0xd8bfd8},
+	{"Tomato", 0xff6347},
+	{"Turquoise", 0x40e0d0},
+	{"Violet", 0xee82ee},
+	{"Wheat", 0xf5deb3},
+	{"White", 0xffffff},
+	{"WhiteSmoke", 0xf5f5f5},
+	{"Yellow", 0xffff00},
+	{"YellowGreen", 0x9acd32},
+}
+
+var namedColorValues = func() map[string]uint32 {
+	values := make(map[string]uint32, len(namedColors))
+	for _, named := range namedColors {
+		values[strings.ToLower(named.Name)] = named.Color
+	}
+	return values
+}()
+
+// parseHueColor parses a hue color written as hex digits (#rgb, #rrggbb,
+// 0xrrggbb, or without prefix), as rgb(r, g, b) with numbers or percentages,
+// or as a CSS color name.
+func parseHueColor(s string) (color.RGBA, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if args, ok := strings.CutPrefix(s, "rgb("); ok {
+		return parseRGBFunction(args)
+	}
+	if args, ok := strings.CutPrefix(s, "rgba("); ok {
+		return parseRGBFunction(args)
+	}
+	if v, ok := namedColorValues[strings.ReplaceAll(strings.ReplaceAll(s, " ", ""), "grey", "gray")]; ok {
+		return rgbColor(v), true
+	}
+	if hex, ok := strings.CutPrefix(s, "#"); ok {
+		s = hex
+	} else if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		s = hex
+	}
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return color.RGBA{}, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return rgbColor(uint32(v)), true
+}
+
+// parseRGBFunction parses the arguments of rgb() or rgba(), separated by
+// commas or spaces. The alpha is ignored as hues are opaque.
+func parseRGBFunction(args string) (color.RGBA, bool) {
+	args, ok := strings.CutSuffix(args, ")")
+	if !ok {
+		return color.RGBA{}, false
+	}
+	args, _, _ = strings.Cut(args, "/")
+	fields := strings.FieldsFunc(args, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) != 3 && len(fields) != 4 {
+		return color.RGBA{}, false
+	}
+	var channels [3]uint8
+	for i := range channels {
+		field := fields[i]
+		max := 255.0
+		if percent, ok := strings.CutSuffix(field, "%"); ok {
+			field, max = percent, 100
+		}
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil || v < 0 || v > max {
+			return color.RGBA{}, false
+		}
+		channels[i] = uint8(math.Round(v / max * 255))
+	}
+	return color.RGBA{R: channels[0], G: channels[1], B: channels[2], A: 0xff}, true
+}
+
+func rgbColor(v uint32) color.RGBA {
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
+
+// nearestColorName returns the name of the named color closest to c, with
+// spaces between words (e.g. "Light Sea Green").
+func nearestColorName(c color.RGBA) string {
+	best, bestDistance := "", -1
+	for _, named := range namedColors {
+		if d := colorDistance(c, rgbColor(named.Color)); bestDistance < 0 || d < bestDistance {
+			best, bestDistance = named.Name, d
+		}
+	}
+	var name strings.Builder
+	for i, r := range best {
+		if i > 0 && unicode.IsUpper(r) {
+			name.WriteByte(' ')
+		}
+		name.WriteRune(r)
+	}
+	return name.String()
+}
+
+// colorDistance approximates how different two colors look, weighting the
+// channels by the mean red level ("redmean").
+func colorDistance(a, b color.RGBA) int {
+	rmean := (int(a.R) + int(b.R)) / 2
+	dr, dg, db := int(a.R)-int(b.R), int(a.G)-int(b.G), int(a.B)-int(b.B)
+	return (512+rmean)*dr*dr>>8 + 4*dg*dg + (767-rmean)*db*db>>8
+}
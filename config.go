@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// envPrefix is the prefix of environment variables overriding the config.
+// The rest of the name is the upper snake case JSON path of the field, e.g.
+// HUES_AUTH_PASSWORD or HUES_LIMITS_UPLOAD_MAX_SIZE.
+const envPrefix = "HUES"
+
+const redacted = "REDACTED"
+
+type Config struct {
+	Listen   []string `json:"listen"`
+	Respacks []string `json:"respacks"`
+	Links    string   `json:"links"`
+	Stats    string   `json:"stats"`
+	Palettes string   `json:"palettes"`
+	Sort     string   `json:"sort"`
+	BasePath string   `json:"basePath"`
+	Server   struct {
+		ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+		IdleTimeout       Duration `json:"idleTimeout"`
+		ShutdownTimeout   Duration `json:"shutdownTimeout"`
+		// ForwardedPrefix honours the X-Forwarded-Prefix header of a reverse
+		// proxy that strips a path prefix before forwarding.
+		ForwardedPrefix bool `json:"forwardedPrefix"`
+		// TrustedProxies are the addresses or CIDR ranges whose
+		// X-Forwarded-For and X-Request-ID headers are honoured.
+		TrustedProxies []string `json:"trustedProxies"`
+
+		trustedProxies []*net.IPNet
+	} `json:"server"`
+	TLS struct {
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	} `json:"tls"`
+	Features struct {
+		Upload  bool `json:"upload"`
+		Admin   bool `json:"admin"`
+		Status  bool `json:"status"`
+		Links   bool `json:"links"`
+		Mixes   bool `json:"mixes"`
+		Metrics bool `json:"metrics"`
+		Stats   bool `json:"stats"`
+		Embed   bool `json:"embed"`
+	} `json:"features"`
+	Embed struct {
+		// FrameAncestors are the sources allowed to embed the /embed/ player,
+		// as in the frame-ancestors directive of Content-Security-Policy.
+		FrameAncestors []string `json:"frameAncestors"`
+		// FrameOptions is the X-Frame-Options header of the other pages.
+		FrameOptions string `json:"frameOptions"`
+	} `json:"embed"`
+	Auth struct {
+		User     string `json:"user"`
+		Password string `json:"password" secret:"true"`
+	} `json:"auth"`
+	Log struct {
+		Access bool `json:"access"`
+	} `json:"log"`
+	Cache struct {
+		MaxAge Duration `json:"maxAge"`
+		// Thumbnails is the directory of resized images, none if empty.
+		Thumbnails string `json:"thumbnails"`
+		// MaxThumbnailsSize is the size in bytes the thumbnails directory is
+		// kept under, unlimited if 0.
+		MaxThumbnailsSize int64 `json:"maxThumbnailsSize"`
+	} `json:"cache"`
+	Limits struct {
+		Upload   UploadLimits  `json:"upload"`
+		Respacks RespackLimits `json:"respacks"`
+		// Links is the maximum number of saved short links.
+		Links int `json:"links"`
+		// LinkCreation is the rate at which each client can save short links.
+		LinkCreation RateLimit `json:"linkCreation"`
+	} `json:"limits"`
+}
+
+func DefaultConfig() *Config {
+	cfg := &Config{
+		Listen:   []string{":8080"},
+		Respacks: []string{"respacks"},
+		Links:    "links.json",
+		Stats:    "stats.json",
+		Palettes: "palettes.json",
+		Sort:     "size",
+		BasePath: "/",
+	}
+	cfg.Server.ReadHeaderTimeout = Duration(10 * time.Second)
+	cfg.Server.IdleTimeout = Duration(2 * time.Minute)
+	cfg.Server.ShutdownTimeout = Duration(30 * time.Second)
+	cfg.Features.Status = true
+	cfg.Features.Links = true
+	cfg.Features.Mixes = true
+	cfg.Features.Stats = true
+	cfg.Features.Embed = true
+	cfg.Embed.FrameAncestors = []string{"*"}
+	cfg.Embed.FrameOptions = "SAMEORIGIN"
+	cfg.Log.Access = true
+	cfg.Cache.MaxAge = Duration(time.Hour)
+	cfg.Cache.Thumbnails = "thumbnails"
+	cfg.Cache.MaxThumbnailsSize = 1 << 30
+	cfg.Limits.Upload = UploadLimits{
+		MaxSize:         256 << 20,
+		MaxUnpackedSize: 1 << 30,
+		MaxEntries:      5000,
+	}
+	cfg.Limits.Links = 100000
+	cfg.Limits.LinkCreation = RateLimit{Requests: 1.0 / 60, Burst: 10}
+	return cfg
+}
+
+// LoadConfig reads the config file (if any) over the defaults and applies
+// the environment variable overrides. Unknown keys are rejected.
+func LoadConfig(filename string) (*Config, error) {
+	cfg := DefaultConfig()
+	if filename != "" {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) Validate() error {
+	if len(cfg.Listen) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	if len(cfg.Respacks) == 0 {
+		return fmt.Errorf("no respack directory")
+	}
+	if _, ok := respackSorts[cfg.Sort]; !ok && !(cfg.Sort == popularSort && cfg.Features.Stats) {
+		return fmt.Errorf("unknown sort: %s", cfg.Sort)
+	}
+	if !strings.HasPrefix(cfg.BasePath, "/") || !strings.HasSuffix(cfg.BasePath, "/") {
+		return fmt.Errorf("base path must start and end with a slash: %s", cfg.BasePath)
+	}
+	trustedProxies, err := parseIPNets(cfg.Server.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	cfg.Server.trustedProxies = trustedProxies
+	if _, err := parseIPNets(cfg.Limits.Respacks.Allowlist); err != nil {
+		return fmt.Errorf("rate limit allowlist: %w", err)
+	}
+	if cfg.Features.Links && cfg.Limits.Links <= 0 {
+		return fmt.Errorf("links feature needs a positive links limit")
+	}
+	if cfg.Features.Embed && len(cfg.Embed.FrameAncestors) == 0 {
+		return fmt.Errorf("embed feature needs frame ancestors")
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if (cfg.Features.Upload || cfg.Features.Admin) && (cfg.Auth.User == "" || cfg.Auth.Password == "") {
+		return fmt.Errorf("upload and admin features need auth credentials")
+	}
+	return nil
+}
+
+func (cfg *Config) BasicAuth() *BasicAuth {
+	if cfg.Auth.User == "" {
+		return nil
+	}
+	return &BasicAuth{User: cfg.Auth.User, Password: cfg.Auth.Password}
+}
+
+// String returns the config as JSON with the secrets redacted.
+func (cfg *Config) String() string {
+	redactedCfg := *cfg
+	redactSecrets(reflect.ValueOf(&redactedCfg).Elem())
+	content, _ := json.MarshalIndent(&redactedCfg, "", "  ")
+	return string(content)
+}
+
+func redactSecrets(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration(0)):
+			redactSecrets(v.Field(i))
+		case field.Tag.Get("secret") == "true" && v.Field(i).String() != "":
+			v.Field(i).SetString(redacted)
+		}
+	}
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		env := prefix + "_" + toUpperSnakeCase(name)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), env); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setFieldFromString(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", env, err)
+		}
+	}
+	return nil
+}
+
+func setFieldFromString(v reflect.Value, value string) error {
+	switch v.Interface().(type) {
+	case Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case []string:
+		var values []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+	return nil
+}
+
+func toUpperSnakeCase(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// Duration is a time.Duration that is written as a string (e.g. "1h30m") in
+// the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
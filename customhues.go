@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const maxCustomHues = 256
+
+// parseHueList parses hues written as comma separated colors, each one
+// optionally followed by a colon and a name (e.g. "ff0000:Red,00ff00").
+// Unnamed hues are named after the closest CSS color.
+func parseHueList(s string) ([]Hue, error) {
+	items := strings.Split(s, ",")
+	if len(items) > maxCustomHues {
+		return nil, fmt.Errorf("too many hues: %d (max %d)", len(items), maxCustomHues)
+	}
+	hues := make([]Hue, 0, len(items))
+	for _, item := range items {
+		value, name, _ := strings.Cut(item, ":")
+		c, ok := parseHueColor(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid hue color: %s", value)
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			name = nearestColorName(c)
+		}
+		hues = append(hues, Hue{Name: name, Color: cssColor(c)})
+	}
+	return hues, nil
+}
+
+// formatHueList is the reverse of parseHueList.
+func formatHueList(hues []Hue) string {
+	items := make([]string, len(hues))
+	for i, hue := range hues {
+		items[i] = strings.TrimPrefix(hue.Color, "#") + ":" + hue.Name
+	}
+	return strings.Join(items, ",")
+}
+
+// customHuesRespackID returns the ID of a virtual respack with the given
+// hues. The name is the one of the palette they come from, if any.
+func customHuesRespackID(hues []Hue, name string) string {
+	params := url.Values{"hues": {formatHueList(hues)}}
+	if name != "" {
+		params.Set("name", name)
+	}
+	return virtualRespackID("custom", params)
+}
+
+func customHuesRespack(params url.Values) (*Respack, error) {
+	hues, err := parseHueList(params.Get("hues"))
+	if err != nil {
+		return nil, err
+	}
+	name := params.Get("name")
+	if name == "" {
+		name = "Custom hues"
+	}
+	rp := newVirtualRespack(customHuesRespackID(hues, params.Get("name")), name)
+	rp.Hues.Hue = hues
+	if err := rp.mountVirtualXMLs(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// findCustomHues returns the virtual respack of a palette of the library
+// or of hues listed in the URL.
+func findCustomHues(value string, lib *PaletteLibrary) (*Respack, error) {
+	if palette, ok := lib.Get(value); ok {
+		return customHuesRespack(url.Values{"hues": {formatHueList(palette.Hues)}, "name": {palette.Name}})
+	}
+	if _, err := parseHueList(value); err != nil {
+		return nil, fmt.Errorf("invalid hues: %w (expected a respack, a palette or colors like ff0000:Red,00ff00)", err)
+	}
+	return customHuesRespack(url.Values{"hues": {value}})
+}
+
+type Palette struct {
+	Name string
+	Hues []Hue
+}
+
+// PaletteLibrary is the set of named palettes the player can be started
+// with. The palettes are stored in a JSON file, written the same way as in
+// URLs: {"Sunset": "ff5e5b:Coral,ffed66:Canary"}.
+type PaletteLibrary struct {
+	palettes map[string]*Palette
+}
+
+func LoadPaletteLibrary(filename string) (*PaletteLibrary, error) {
+	var lists map[string]string
+	if err := readJSONFile(filename, &lists); err != nil {
+		return nil, err
+	}
+	lib := &PaletteLibrary{palettes: make(map[string]*Palette, len(lists))}
+	for name, list := range lists {
+		hues, err := parseHueList(list)
+		if err != nil {
+			return nil, fmt.Errorf("palette %s: %w", name, err)
+		}
+		lib.palettes[strings.ToLower(name)] = &Palette{Name: name, Hues: hues}
+	}
+	return lib, nil
+}
+
+// Get returns a palette by its case insensitive name.
+func (lib *PaletteLibrary) Get(name string) (*Palette, bool) {
+	palette, ok := lib.palettes[strings.ToLower(name)]
+	return palette, ok
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultEmbedWidth  = 640
+	defaultEmbedHeight = 360
+)
+
+// OEmbed is an oEmbed response of the "rich" type.
+type OEmbed struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	Title        string `json:"title,omitempty"`
+	HTML         string `json:"html"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// newOEmbed returns the iframe of an embedded player, scaled down to the
+// maxwidth and maxheight query parameters of the oEmbed request.
+func newOEmbed(embedURL, providerURL, title string, query url.Values) (*OEmbed, error) {
+	width, height := defaultEmbedWidth, defaultEmbedHeight
+	for _, param := range []string{"maxwidth", "maxheight"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		max, err := strconv.Atoi(value)
+		if err != nil || max <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", param, value)
+		}
+		if param == "maxwidth" && width > max {
+			width, height = max, height*max/width
+		} else if param == "maxheight" && height > max {
+			width, height = width*max/height, max
+		}
+	}
+	return &OEmbed{
+		Version:      "1.0",
+		Type:         "rich",
+		ProviderName: "0x40 Hues",
+		ProviderURL:  providerURL,
+		Title:        title,
+		HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" allow="autoplay; fullscreen" allowfullscreen></iframe>`,
+			html.EscapeString(embedURL), width, height),
+		Width:  width,
+		Height: height,
+	}, nil
+}
+
+// frameOptions sets the X-Frame-Options header, unless it is empty.
+func frameOptions(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if value == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Frame-Options", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// frameAncestors allows the origins to embed the response in a frame.
+func frameAncestors(origins []string) func(http.Handler) http.Handler {
+	policy := "frame-ancestors " + strings.Join(origins, " ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Del("X-Frame-Options")
+			w.Header().Set("Content-Security-Policy", policy)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+const (
+	// bitmapFontSize is the size of the glyph cells of pixel fonts like
+	// PetMe64, which draw every glyph with squares of an 8x8 grid.
+	bitmapFontSize = 8
+	// glyphSheetColumns is the number of glyphs per row of a glyph sheet.
+	glyphSheetColumns = 16
+	// glyphSheetFirst is the rune of the top left glyph of a glyph sheet.
+	glyphSheetFirst = ' '
+)
+
+// bitmapFont is a pixel font with a bit mask per row of each glyph, the most
+// significant bit being the leftmost pixel.
+type bitmapFont struct {
+	glyphs map[rune][bitmapFontSize]uint8
+}
+
+// loadGlyphSheet reads a pixel font from an image of consecutive glyphs
+// starting at glyphSheetFirst, light on dark. Blank cells other than the
+// spaces are glyphs missing from the font.
+func loadGlyphSheet(data []byte) (*bitmapFont, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != glyphSheetColumns*bitmapFontSize || bounds.Dy()%bitmapFontSize != 0 {
+		return nil, errors.New("invalid glyph sheet size")
+	}
+	font := &bitmapFont{glyphs: make(map[rune][bitmapFontSize]uint8)}
+	cells := glyphSheetColumns * bounds.Dy() / bitmapFontSize
+	for i := 0; i < cells; i++ {
+		x0 := bounds.Min.X + i%glyphSheetColumns*bitmapFontSize
+		y0 := bounds.Min.Y + i/glyphSheetColumns*bitmapFontSize
+		var glyph [bitmapFontSize]uint8
+		for row := range glyph {
+			for col := 0; col < bitmapFontSize; col++ {
+				if color.GrayModel.Convert(img.At(x0+col, y0+row)).(color.Gray).Y >= 0x80 {
+					glyph[row] |= 0x80 >> col
+				}
+			}
+		}
+		r := glyphSheetFirst + rune(i)
+		if glyph != ([bitmapFontSize]uint8{}) || r == ' ' || r == '\u00a0' {
+			font.glyphs[r] = glyph
+		}
+	}
+	if _, ok := font.glyphs['?']; !ok {
+		return nil, errors.New("glyph sheet has no '?'")
+	}
+	return font, nil
+}
+
+// drawText draws the text with each font pixel scaled to a square of the
+// given size. Runes missing from the font are drawn as '?'.
+func (f *bitmapFont) drawText(img *image.RGBA, x, y, scale int, text string, c color.Color) {
+	for _, r := range text {
+		glyph, ok := f.glyphs[r]
+		if !ok {
+			glyph = f.glyphs['?']
+		}
+		for row, bits := range glyph {
+			for col := 0; col < bitmapFontSize; col++ {
+				if bits&(0x80>>col) == 0 {
+					continue
+				}
+				rect := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+				fillRect(img, rect, c)
+			}
+		}
+		x += bitmapFontSize * scale
+	}
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.Color) {
+	rect = rect.Intersect(img.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+}
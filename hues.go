@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// huesRespackID returns the ID of a virtual respack that only contains the
+// hues of the given respack, so the player can use them without loading
+// its songs and images. An empty set means the default one.
+func huesRespackID(respackID, set string) string {
+	params := url.Values{"respack": {respackID}}
+	if set != "" {
+		params.Set("set", set)
+	}
+	return virtualRespackID("hues", params)
+}
+
+func huesRespack(params url.Values, lookup respackLookup) (*Respack, error) {
+	respackID, setName := params.Get("respack"), params.Get("set")
+	respack, ok := lookup(respackID)
+	if !ok {
+		return nil, fmt.Errorf("unknown respack: %s", respackID)
+	}
+	if len(respack.Hues.Hue) == 0 {
+		return nil, fmt.Errorf("respack has no hues: %s", respackID)
+	}
+	name := respack.Name() + " (hues)"
+	hues := respack.Hues.Hue
+	if setName != "" {
+		set, ok := respack.HueSet(setName)
+		if !ok {
+			return nil, fmt.Errorf("hue set %w: %s", errNotFound, setName)
+		}
+		name = respack.Name() + " (" + set.Name + " hues)"
+		hues = set.Hue
+	}
+	rp := newVirtualRespack(huesRespackID(respackID, setName), name)
+	rp.Hues.Hue = hues
+	if err := rp.mountVirtualXMLs(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// findHueSet returns the first of the respacks with the named hue set. The
+// builtin respack is the fallback of respacks without hues, like in the
+// player.
+func findHueSet(respacks []*Respack, name string) (string, error) {
+	haveHues := false
+	for _, respack := range respacks {
+		if _, ok := respack.HueSet(name); ok {
+			return respack.ID, nil
+		}
+		haveHues = haveHues || len(respack.Hues.Hue) > 0
+	}
+	if _, ok := builtinR.HueSet(name); ok && !haveHues {
+		return builtinR.ID, nil
+	}
+	return "", fmt.Errorf("hue set %w: %s", errNotFound, name)
+}
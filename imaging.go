@@ -0,0 +1,159 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+)
+
+type resampleWeight struct {
+	index  int
+	weight float32
+}
+
+// catmullRom is the Catmull-Rom cubic filter with a support of 2.
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return 1.5*x*x*x - 2.5*x*x + 1
+	case x < 2:
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	default:
+		return 0
+	}
+}
+
+// resampleWeights returns the source pixels and their weights for each
+// destination pixel. The filter is widened when downscaling so that every
+// source pixel contributes.
+func resampleWeights(srcSize, dstSize int) [][]resampleWeight {
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := math.Max(scale, 1)
+	support := 2 * filterScale
+	weights := make([][]resampleWeight, dstSize)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		var sum float64
+		var ws []resampleWeight
+		for j := int(math.Ceil(center - support)); j <= int(math.Floor(center+support)); j++ {
+			w := catmullRom((float64(j) - center) / filterScale)
+			if w == 0 {
+				continue
+			}
+			index := j
+			if index < 0 {
+				index = 0
+			} else if index >= srcSize {
+				index = srcSize - 1
+			}
+			ws = append(ws, resampleWeight{index: index, weight: float32(w)})
+			sum += w
+		}
+		for k := range ws {
+			ws[k].weight /= float32(sum)
+		}
+		weights[i] = ws
+	}
+	return weights
+}
+
+// imageRenders limits the number of images decoded and resized at once, as
+// each one holds its full size pixels.
+var imageRenders = make(chan struct{}, runtime.NumCPU())
+
+func acquireImageRender() { imageRenders <- struct{}{} }
+
+func releaseImageRender() { <-imageRenders }
+
+// resizeImage scales the image to the given size with a Catmull-Rom filter.
+// It works on premultiplied colors so that transparent pixels don't bleed
+// into the edges of opaque ones.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	pix, stride, premultiply := imagePixels(src)
+
+	columns := resampleWeights(srcWidth, width)
+	tmp := make([]float32, width*srcHeight*4)
+	for y := 0; y < srcHeight; y++ {
+		row := pix[y*stride:]
+		for x, ws := range columns {
+			var c [4]float32
+			for _, w := range ws {
+				p := row[w.index*4 : w.index*4+4]
+				r, g, b, a := float32(p[0]), float32(p[1]), float32(p[2]), float32(p[3])
+				if premultiply {
+					r, g, b = r*a/0xff, g*a/0xff, b*a/0xff
+				}
+				c[0] += r * w.weight
+				c[1] += g * w.weight
+				c[2] += b * w.weight
+				c[3] += a * w.weight
+			}
+			copy(tmp[(y*width+x)*4:], c[:])
+		}
+	}
+
+	rows := resampleWeights(srcHeight, height)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, ws := range rows {
+		for x := 0; x < width; x++ {
+			var c [4]float32
+			for _, w := range ws {
+				i := (w.index*width + x) * 4
+				for k := range c {
+					c[k] += tmp[i+k] * w.weight
+				}
+			}
+			alpha := clampChannel(c[3], 0xff)
+			i := dst.PixOffset(x, y)
+			for k := 0; k < 3; k++ {
+				dst.Pix[i+k] = clampChannel(c[k], alpha)
+			}
+			dst.Pix[i+3] = alpha
+		}
+	}
+	return dst
+}
+
+// imagePixels returns the 8-bit RGBA rows of the image, and whether they
+// still have to be premultiplied by their alpha. Images other than RGBA and
+// NRGBA ones are converted to RGBA first.
+func imagePixels(src image.Image) (pix []uint8, stride int, premultiply bool) {
+	bounds := src.Bounds()
+	switch img := src.(type) {
+	case *image.RGBA:
+		return img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, false
+	case *image.NRGBA:
+		return img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, true
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	return rgba.Pix, rgba.Stride, false
+}
+
+// clampChannel rounds a channel value and keeps it within [0, max], max
+// being the alpha for premultiplied colors.
+func clampChannel(v float32, max uint8) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v+0.5 < float32(max) {
+		return uint8(v + 0.5)
+	}
+	return max
+}
+
+// fitSize returns the largest size with the aspect ratio of the source that
+// fits in the box. Smaller sources are only scaled up if upscale is set.
+func fitSize(srcWidth, srcHeight, maxWidth, maxHeight int, upscale bool) (int, int) {
+	if !upscale && srcWidth <= maxWidth && srcHeight <= maxHeight {
+		return srcWidth, srcHeight
+	}
+	scale := math.Min(float64(maxWidth)/float64(srcWidth), float64(maxHeight)/float64(srcHeight))
+	width := int(math.Max(1, math.Round(float64(srcWidth)*scale)))
+	height := int(math.Max(1, math.Round(float64(srcHeight)*scale)))
+	return width, height
+}
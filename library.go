@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	disabledRespacksFile = "disabled.json"
+	respackCloseDelay    = 10 * time.Second
+)
+
+var errRespackExists = errors.New("a respack with the same name already exists")
+
+// LibraryEntry is the load status of a respack file in the respack directory.
+type LibraryEntry struct {
+	ID       string
+	Dir      string
+	Filename string
+	Respack  *Respack
+	Error    *RespackProblem
+	Warnings []*RespackProblem
+	Disabled bool
+	LoadedAt time.Time
+
+	size    int64
+	modTime time.Time
+}
+
+func (e *LibraryEntry) Status() string {
+	switch {
+	case e.Respack == nil:
+		return "failed"
+	case e.Disabled:
+		return "disabled"
+	default:
+		return "loaded"
+	}
+}
+
+// Library holds the respacks of the respack directories. Disabled respacks
+// and the ones that failed to load are kept as entries, but are not served.
+// The first directory is the primary one: uploads and the list of disabled
+// respacks go there.
+type Library struct {
+	scanMtx  sync.Mutex // serializes changes of the respack directories
+	mtx      sync.RWMutex
+	dirs     []string
+	entries  map[string]*LibraryEntry
+	respacks []*Respack
+	// generation changes whenever the served respacks do, so that what is
+	// built from them can be cached per generation.
+	generation uint64
+	// metaErrors are the library metadata files that failed to load
+	metaErrors []*RespackStatus
+}
+
+func LoadLibrary(dirs ...string) (*Library, error) {
+	lib := &Library{
+		dirs:    dirs,
+		entries: make(map[string]*LibraryEntry),
+	}
+	if err := lib.Rescan(); err != nil {
+		return nil, err
+	}
+	return lib, nil
+}
+
+// Dir returns the primary respack directory.
+func (lib *Library) Dir() string {
+	return lib.dirs[0]
+}
+
+// Rescan loads new and modified respack files and drops the ones that were
+// removed from the respack directories.
+func (lib *Library) Rescan() error {
+	lib.scanMtx.Lock()
+	defer lib.scanMtx.Unlock()
+
+	var disabled []string
+	if err := readJSONFile(filepath.Join(lib.Dir(), disabledRespacksFile), &disabled); err != nil {
+		return err
+	}
+
+	lib.mtx.RLock()
+	oldEntries := lib.entries
+	lib.mtx.RUnlock()
+
+	entries := make(map[string]*LibraryEntry)
+	for _, dir := range lib.dirs {
+		if err := lib.scanDir(dir, oldEntries, entries); err != nil {
+			return err
+		}
+	}
+
+	respacks := make(map[string][]*Respack)
+	for _, entry := range entries {
+		entry.Disabled = containsFold(disabled, entry.ID)
+		if entry.Respack != nil {
+			respacks[entry.Dir] = append(respacks[entry.Dir], entry.Respack)
+		}
+	}
+
+	metas := make(map[string]*RespackMeta)
+	var metaErrors []*RespackStatus
+	for dir, respacks := range respacks {
+		dirMetas, problems, err := LoadRespackMeta(dir, respacks)
+		if err != nil {
+			// keep the metadata the respacks already have
+			log.Println("metadata -", err)
+			metaErrors = append(metaErrors, &RespackStatus{Filename: filepath.Join(filepath.Base(dir), libraryMetaFile), Error: err.Error()})
+		}
+		for _, respack := range respacks {
+			if meta, ok := dirMetas[respack.ID]; ok {
+				metas[respack.ID] = meta
+			}
+			entry := entries[respack.ID]
+			entry.Warnings = append(respack.Validate(), respack.Warnings()...)
+			if problem, ok := problems[respack.ID]; ok {
+				log.Println(respack.ID, "-", problem)
+				entry.Warnings = append(entry.Warnings, problem)
+			}
+		}
+	}
+
+	lib.mtx.Lock()
+	for id, meta := range metas {
+		entries[id].Respack.meta.Store(meta)
+	}
+	lib.entries = entries
+	lib.metaErrors = metaErrors
+	lib.update()
+	lib.mtx.Unlock()
+
+	for id, old := range oldEntries {
+		if entry := entries[id]; old.Respack != nil && (entry == nil || entry.Respack != old.Respack) {
+			// requests that got the respack before the swap may still open
+			// its files, and the ones they opened keep it open until closed
+			respack := old.Respack
+			time.AfterFunc(respackCloseDelay, func() { respack.Close() })
+		}
+	}
+	return nil
+}
+
+func (lib *Library) scanDir(dir string, oldEntries, entries map[string]*LibraryEntry) error {
+	filenames, err := listRespacks(dir)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			// e.g. removed since the directory was listed
+			log.Println(filename, "-", err)
+			continue
+		}
+		id := respackFilenameToID(filename)
+		if other, ok := entries[id]; ok {
+			log.Println(id, "- already loaded from", other.Dir)
+			continue
+		}
+		if old, ok := oldEntries[id]; ok && old.Dir == dir && old.size == fi.Size() && old.modTime.Equal(fi.ModTime()) {
+			entry := *old
+			entries[id] = &entry
+			continue
+		}
+		entry := &LibraryEntry{
+			ID:       id,
+			Dir:      dir,
+			Filename: filepath.Base(filename),
+			LoadedAt: time.Now(),
+			size:     fi.Size(),
+			modTime:  fi.ModTime(),
+		}
+		respack, err := LoadRespackZIP(filename)
+		if err != nil {
+			log.Println(id, "-", err)
+			entry.Error = newRespackProblem(err)
+		} else {
+			log.Println(id, "loaded -",
+				respack.ImageCount(), "images -",
+				respack.SongCount(), "songs")
+			entry.Respack = respack
+		}
+		entries[id] = entry
+	}
+	return nil
+}
+
+// update rebuilds the sorted list of served respacks. The caller must hold
+// the write lock.
+func (lib *Library) update() {
+	lib.respacks = lib.respacks[:0]
+	for _, entry := range lib.entries {
+		if entry.Respack != nil && !entry.Disabled {
+			lib.respacks = append(lib.respacks, entry.Respack)
+		}
+	}
+	sortRespacks(lib.respacks)
+	lib.generation++
+}
+
+// Respacks returns the sorted list of served respacks.
+func (lib *Library) Respacks() []*Respack {
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+	return append([]*Respack(nil), lib.respacks...)
+}
+
+// Entries returns every respack file of the library sorted by ID.
+func (lib *Library) Entries() []*LibraryEntry {
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+	entries := make([]*LibraryEntry, 0, len(lib.entries))
+	for _, entry := range lib.entries {
+		entry := *entry
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// Generation returns a number that changes whenever the served respacks do.
+func (lib *Library) Generation() uint64 {
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+	return lib.generation
+}
+
+func (lib *Library) Get(id string) (*Respack, bool) {
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+	if entry, ok := lib.entries[id]; ok && entry.Respack != nil && !entry.Disabled {
+		return entry.Respack, true
+	}
+	return nil, false
+}
+
+// AddFile links a file into the primary respack directory under the given
+// name and loads it. Linking fails if the name is taken, even by a file that
+// isn't loaded yet. The file is removed again if it can't be loaded, so that
+// the next rescan doesn't pick it up.
+func (lib *Library) AddFile(src, name string) (respack *Respack, err error) {
+	lib.scanMtx.Lock()
+	defer lib.scanMtx.Unlock()
+	filename := filepath.Join(lib.Dir(), name)
+	id := respackFilenameToID(filename)
+	lib.mtx.RLock()
+	_, exists := lib.entries[id]
+	lib.mtx.RUnlock()
+	if exists {
+		return nil, errRespackExists
+	}
+	if err := os.Link(src, filename); errors.Is(err, fs.ErrExist) {
+		return nil, errRespackExists
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	respack, err = LoadRespackZIP(filename)
+	if err != nil {
+		return nil, err
+	}
+	metas, _, err := LoadRespackMeta(lib.Dir(), []*Respack{respack})
+	if err != nil {
+		respack.Close()
+		return nil, err
+	}
+	respack.meta.Store(metas[id])
+	lib.mtx.Lock()
+	defer lib.mtx.Unlock()
+	lib.entries[id] = &LibraryEntry{
+		ID:       id,
+		Dir:      lib.Dir(),
+		Filename: name,
+		Respack:  respack,
+		Warnings: append(respack.Validate(), respack.Warnings()...),
+		LoadedAt: time.Now(),
+		size:     fi.Size(),
+		modTime:  fi.ModTime(),
+	}
+	lib.update()
+	return respack, nil
+}
+
+// SetDisabled hides or shows a respack without touching its file. The list of
+// disabled respacks is kept in the respack directory.
+func (lib *Library) SetDisabled(id string, disabled bool) error {
+	lib.scanMtx.Lock()
+	defer lib.scanMtx.Unlock()
+	lib.mtx.Lock()
+	defer lib.mtx.Unlock()
+	entry, ok := lib.entries[id]
+	if !ok {
+		return fmt.Errorf("unknown respack: %s", id)
+	}
+	var listed []string
+	if err := readJSONFile(filepath.Join(lib.Dir(), disabledRespacksFile), &listed); err != nil {
+		return err
+	}
+	entry.Disabled = disabled
+	lib.update()
+
+	// respacks that are listed but not there, like the ones that are only
+	// moved out for a while, stay disabled
+	ids := []string{}
+	for _, listedID := range listed {
+		if !lib.hasEntryFold(listedID) && !containsFold(ids, listedID) {
+			ids = append(ids, listedID)
+		}
+	}
+	for _, entry := range lib.entries {
+		if entry.Disabled {
+			ids = append(ids, entry.ID)
+		}
+	}
+	sort.Strings(ids)
+	return writeJSONFile(filepath.Join(lib.Dir(), disabledRespacksFile), ids)
+}
+
+// hasEntryFold reports whether there is an entry with the ID regardless of
+// case, as in the list of disabled respacks. The caller must hold the lock.
+func (lib *Library) hasEntryFold(id string) bool {
+	for entryID := range lib.entries {
+		if strings.EqualFold(entryID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes every respack. The library must not be used afterwards.
+func (lib *Library) Close() error {
+	lib.scanMtx.Lock()
+	defer lib.scanMtx.Unlock()
+	lib.mtx.Lock()
+	defer lib.mtx.Unlock()
+	var errs []error
+	for _, entry := range lib.entries {
+		if entry.Respack != nil {
+			errs = append(errs, entry.Respack.Close())
+		}
+	}
+	lib.entries = make(map[string]*LibraryEntry)
+	lib.update()
+	return errors.Join(errs...)
+}
+
+func listRespacks(respackDir string) ([]string, error) {
+	var respacks []string
+	dir, err := os.Open(respackDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	fileInfos, err := dir.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".zip") {
+			respacks = append(respacks, filepath.Join(respackDir, fileInfo.Name()))
+		}
+	}
+	sort.Strings(respacks)
+	return respacks, nil
+}
+
+func sortRespacks(respacks []*Respack) {
+	sort.Slice(respacks, func(i, j int) bool {
+		iResCount := respacks[i].ImageCount() + respacks[i].SongCount()
+		jResCount := respacks[j].ImageCount() + respacks[j].SongCount()
+		return iResCount > jResCount || (iResCount == jResCount && respacks[i].Name() < respacks[j].Name())
+	})
+}
+
+func sortRespacksByName(respacks []*Respack) {
+	sort.Slice(respacks, func(i, j int) bool {
+		return strings.ToLower(respacks[i].Name()) < strings.ToLower(respacks[j].Name())
+	})
+}
+
+var respackSorts = map[string]func([]*Respack){
+	"size": sortRespacks,
+	"name": sortRespacksByName,
+}
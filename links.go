@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	minLinkCodeLength = 6
+	maxLinkURLLength  = 4096
+)
+
+var errLinkStoreFull = errors.New("no more links can be saved")
+
+// SavedMix is a player configuration that can be shared by a short link.
+// Per-item mixes have no respacks; their songs and images are in the query.
+type SavedMix struct {
+	Respacks []string   `json:"respacks,omitempty"`
+	Query    url.Values `json:"query,omitempty"`
+}
+
+// parsePlayerURL parses a player URL, either relative to the base path of the
+// app or absolute.
+func parsePlayerURL(rawURL, basePath string) (*SavedMix, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	path := strings.Trim(strings.TrimPrefix(u.Path, basePath), "/")
+	path = strings.TrimPrefix(path, "embed/")
+	switch {
+	case path == "mix":
+		if _, err := parseMix(query); err != nil {
+			return nil, err
+		}
+		return &SavedMix{Query: query}, nil
+	case path == "custom":
+		respacks := strings.Split(query.Get("packs"), ",")
+		query.Del("packs")
+		return &SavedMix{Respacks: respacks, Query: query}, nil
+	case path != "" && !strings.Contains(path, "/"):
+		return &SavedMix{Respacks: strings.Split(path, ","), Query: query}, nil
+	default:
+		return nil, fmt.Errorf("not a player URL: %s", rawURL)
+	}
+}
+
+// RespackIDs returns the respacks the player has to load for this mix.
+func (m *SavedMix) RespackIDs() ([]string, error) {
+	if len(m.Respacks) > 0 {
+		return m.Respacks, nil
+	}
+	mix, err := parseMix(m.Query)
+	if err != nil {
+		return nil, err
+	}
+	return []string{mix.ID()}, nil
+}
+
+// embedPath returns the path of the embedded player of the mix relative to
+// the base path.
+func (m *SavedMix) embedPath() (string, error) {
+	respackIDs, err := m.RespackIDs()
+	if err != nil {
+		return "", err
+	}
+	query := make(url.Values)
+	for key, values := range m.Query {
+		if len(m.Respacks) == 0 && (key == "songs" || key == "images") {
+			continue
+		}
+		query[key] = values
+	}
+	path := "embed/" + strings.Join(respackIDs, ",") + "/"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path, nil
+}
+
+func (m *SavedMix) canonical() string {
+	return strings.Join(m.Respacks, ",") + "?" + m.Query.Encode()
+}
+
+// LinkStore keeps the saved mixes in a JSON file, up to maxLinks of them. New
+// links are appended to a journal next to it, which is merged into the JSON
+// file when the store is loaded.
+type LinkStore struct {
+	mtx      sync.RWMutex
+	filename string
+	maxLinks int
+	links    map[string]*SavedMix
+	journal  *os.File
+}
+
+// linkJournalEntry is a line of the journal of a link store.
+type linkJournalEntry struct {
+	Code string    `json:"code"`
+	Mix  *SavedMix `json:"mix"`
+}
+
+func LoadLinkStore(filename string, maxLinks int) (*LinkStore, error) {
+	store := &LinkStore{
+		filename: filename,
+		maxLinks: maxLinks,
+		links:    make(map[string]*SavedMix),
+	}
+	if err := readJSONFile(filename, &store.links); err != nil {
+		return nil, err
+	}
+	journalFile := filename + ".journal"
+	n, err := store.readJournal(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		if err := writeJSONFile(filename, store.links); err != nil {
+			return nil, err
+		}
+	}
+	store.journal, err = os.OpenFile(journalFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// readJournal adds the links of the journal and returns how many there were.
+// A last line without a newline was cut off while being written and is left
+// out.
+func (s *LinkStore) readJournal(filename string) (int, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines[:len(lines)-1] {
+		var entry linkJournalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Code == "" || entry.Mix == nil {
+			return 0, fmt.Errorf("%s:%d: invalid link", filepath.Base(filename), i+1)
+		}
+		s.links[entry.Code] = entry.Mix
+	}
+	return len(lines) - 1, nil
+}
+
+func (s *LinkStore) Get(code string) (*SavedMix, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	link, ok := s.links[code]
+	return link, ok
+}
+
+// Add saves the mix and returns its code. Adding the same mix again returns
+// the same code.
+func (s *LinkStore) Add(mix *SavedMix) (string, error) {
+	canonical := mix.canonical()
+	hash := sha256.Sum256([]byte(canonical))
+	encodedHash := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for length := minLinkCodeLength; length <= len(encodedHash); length++ {
+		code := encodedHash[:length]
+		existing, ok := s.links[code]
+		if ok && existing.canonical() == canonical {
+			return code, nil
+		} else if ok {
+			continue
+		}
+		if len(s.links) >= s.maxLinks {
+			return "", errLinkStoreFull
+		}
+		if err := s.append(code, mix); err != nil {
+			return "", err
+		}
+		s.links[code] = mix
+		return code, nil
+	}
+	return "", fmt.Errorf("no free link code")
+}
+
+// append writes a link to the journal in a single write, so a line is only
+// missing its end if the server stopped in the middle of it.
+func (s *LinkStore) append(code string, mix *SavedMix) error {
+	line, err := json.Marshal(linkJournalEntry{Code: code, Mix: mix})
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the journal. The links stay in it until the store is loaded
+// again.
+func (s *LinkStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.journal.Close()
+}
+
+func writeJSONFile(filename string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultLiteHeight = 512
+	liteCookie        = "lite"
+)
+
+// liteRespackID returns the ID of the data saver variant of a respack, whose
+// images are scaled down to the given height.
+func liteRespackID(respackID string, height int) string {
+	return virtualRespackID("lite", url.Values{"respack": {respackID}, "height": {strconv.Itoa(height)}})
+}
+
+// parseLiteOption returns the image height of the data saver mode, 0 if it
+// is off.
+func parseLiteOption(value string) (int, error) {
+	if on, err := strconv.ParseBool(value); err == nil {
+		if on {
+			return defaultLiteHeight, nil
+		}
+		return 0, nil
+	}
+	height, err := strconv.Atoi(value)
+	if err != nil || !allowedThumbnailSize(height) {
+		return 0, fmt.Errorf("invalid lite: %s (expected true, false or one of %s)", value, strings.Trim(fmt.Sprint(thumbnailSizes), "[]"))
+	}
+	return height, nil
+}
+
+// sessionLiteOption applies the data saver mode remembered for the session
+// to the query, unless the query sets it. A cookie with a value that isn't
+// valid anymore, like a size that was dropped, is cleared.
+func sessionLiteOption(w http.ResponseWriter, r *http.Request, query url.Values) {
+	cookie, err := r.Cookie(liteCookie)
+	if err != nil || query.Has("lite") {
+		return
+	}
+	if _, err := parseLiteOption(cookie.Value); err != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:   liteCookie,
+			Path:   requestBase(r),
+			MaxAge: -1,
+		})
+		return
+	}
+	query.Set("lite", cookie.Value)
+}
+
+// rememberLiteOption remembers the data saver mode for the session.
+func rememberLiteOption(w http.ResponseWriter, r *http.Request, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     liteCookie,
+		Value:    value,
+		Path:     requestBase(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// liteRespack is a respack with the songs and hues of another one, but with
+// images served in a reduced size. Images of mixes are served by the data
+// saver variant of the respack they come from.
+func liteRespack(params url.Values, lookup respackLookup) (*Respack, error) {
+	respackID := params.Get("respack")
+	height, err := strconv.Atoi(params.Get("height"))
+	if err != nil || !allowedThumbnailSize(height) {
+		return nil, fmt.Errorf("invalid height: %s", params.Get("height"))
+	}
+	if kind, _, err := parseVirtualRespackID(respackID); err == nil && kind == "lite" {
+		return nil, fmt.Errorf("nested data saver respack: %s", respackID)
+	}
+	respack, err := findRespack(respackID, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := newVirtualRespack(liteRespackID(respackID, height), respack.Name())
+	for name, fh := range respack.fileHandlers {
+		rp.fileHandlers[name] = fh
+	}
+	rp.Info = respack.Info
+	rp.Hues = respack.Hues
+	rp.hueSets = respack.hueSets
+	rp.modTime = respack.modTime
+	rp.imageHeight = height
+	for _, song := range respack.Songs.Song {
+		if song.Source == "" {
+			song.Source = respackResourceSource(respack.ID, song.Name)
+			if song.Buildup != "" {
+				song.BuildupSource = respackResourceSource(respack.ID, song.Buildup)
+			}
+		}
+		rp.Songs.Song = append(rp.Songs.Song, song)
+	}
+	for _, image := range respack.Images.Image {
+		sourceID := respack.ID
+		if image.Source != "" {
+			var ok bool
+			if sourceID, ok = respackResourceID(image.Source); !ok {
+				rp.Images.Image = append(rp.Images.Image, image)
+				continue
+			}
+		}
+		image.Source = respackResourceSource(liteRespackID(sourceID, height), image.Name)
+		rp.Images.Image = append(rp.Images.Image, image)
+	}
+	if err := rp.mountVirtualXMLs(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
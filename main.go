@@ -1,72 +1,130 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"sort"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func listRespacks(respackDir string) ([]string, error) {
-	var respacks []string
-	dir, err := os.Open(respackDir)
-	if err != nil {
-		return nil, err
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "palette" {
+		if err := paletteCommand(os.Args[2:]); err != nil {
+			log.Fatalln("palette -", err)
+		}
+		return
 	}
-	defer dir.Close()
-	fileInfos, err := dir.Readdir(0)
+
+	var configFile, addr, respackDir string
+	flag.StringVar(&configFile, "config", "", "JSON config file")
+	flag.StringVar(&addr, "addr", "", "HTTP listener address (overrides config)")
+	flag.StringVar(&respackDir, "respacks", "", "Respack directory (overrides config)")
+	flag.Parse()
+
+	cfg, err := LoadConfig(configFile)
 	if err != nil {
-		return nil, err
+		log.Fatalln("config -", err)
 	}
-	for _, fileInfo := range fileInfos {
-		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".zip") {
-			name := fileInfo.Name()
-			respacks = append(respacks, strings.TrimSuffix(name, ".zip"))
-		}
+	if addr != "" {
+		cfg.Listen = []string{addr}
 	}
-	return respacks, nil
-}
-
-func sortRespacks(respacks []*Respack) {
-	sort.Slice(respacks, func(i, j int) bool {
-		iResCount := respacks[i].ImageCount() + respacks[i].SongCount()
-		jResCount := respacks[j].ImageCount() + respacks[j].SongCount()
-		return iResCount > jResCount || (iResCount == jResCount && respacks[i].Name() < respacks[j].Name())
-	})
-}
+	if respackDir != "" {
+		cfg.Respacks = []string{respackDir}
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalln("config -", err)
+	}
+	log.Println("Effective config:", cfg)
 
-func main() {
-	var addr, respackDir string
-	flag.StringVar(&addr, "addr", ":8080", "HTTP listener address")
-	flag.StringVar(&respackDir, "respacks", "respacks", "Respack directory")
-	flag.Parse()
+	if !cfg.Features.Mixes {
+		disableVirtualRespacks("mix")
+	}
 
-	respackIDs, err := listRespacks(respackDir)
+	log.Println("Loading respacks")
+	library, err := LoadLibrary(cfg.Respacks...)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Loading respacks")
-	var respacks []*Respack
-	for _, respackID := range respackIDs {
-		respack, err := LoadRespackZIP(filepath.Join(respackDir, respackID+".zip"))
+	var links *LinkStore
+	if cfg.Features.Links {
+		links, err = LoadLinkStore(cfg.Links, cfg.Limits.Links)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var stats *PlayStats
+	if cfg.Features.Stats {
+		stats, err = LoadPlayStats(cfg.Stats)
 		if err != nil {
-			log.Println(respackID, "-", err)
-		} else {
-			log.Println(respackID, "loaded -",
-				respack.ImageCount(), "images -",
-				respack.SongCount(), "songs")
-			respacks = append(respacks, respack)
+			panic(err)
 		}
 	}
 
-	sortRespacks(respacks)
+	palettes, err := LoadPaletteLibrary(cfg.Palettes)
+	if err != nil {
+		log.Fatalln("palettes -", err)
+	}
+
+	var uploader *Uploader
+	if cfg.Features.Upload {
+		uploader = NewUploader(library.Dir(), cfg.Limits.Upload, library)
+	}
 
-	router := GetHandlers(respacks)
+	router := GetHandlers(cfg, library, links, stats, palettes, uploader)
+	servers, err := NewServers(cfg, router)
+	if err != nil {
+		log.Fatalln("server -", err)
+	}
 
-	log.Println("Starting web server on address", addr)
-	http.ListenAndServe(addr, router)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- servers.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		if stats != nil {
+			stats.Close()
+		}
+		if links != nil {
+			links.Close()
+		}
+		library.Close()
+		log.Fatalln("server -", err)
+	case sig := <-signals:
+		log.Println("Received", sig, "- shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+	defer cancel()
+	exitCode := 0
+	if err := servers.Shutdown(ctx); err != nil {
+		log.Println("shutdown -", err)
+		exitCode = 1
+	}
+	if stats != nil {
+		if err := stats.Close(); err != nil {
+			log.Println("shutdown -", err)
+			exitCode = 1
+		}
+	}
+	if links != nil {
+		if err := links.Close(); err != nil {
+			log.Println("shutdown -", err)
+			exitCode = 1
+		}
+	}
+	if err := library.Close(); err != nil {
+		log.Println("shutdown -", err)
+		exitCode = 1
+	}
+	log.Println("Shutdown complete")
+	os.Exit(exitCode)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const libraryMetaFile = "library.json"
+
+type RespackMeta struct {
+	Tags        []string `json:"tags,omitempty"`
+	Collections []string `json:"collections,omitempty"`
+}
+
+func (m *RespackMeta) merge(other RespackMeta) {
+	m.Tags = mergeNames(m.Tags, other.Tags)
+	m.Collections = mergeNames(m.Collections, other.Collections)
+}
+
+// LoadRespackMeta reads the metadata of the respacks of a directory by
+// respack ID. A respack with an invalid sidecar file only gets its metadata
+// from the library file; the problem is returned by respack ID.
+func LoadRespackMeta(respackDir string, respacks []*Respack) (map[string]*RespackMeta, map[string]*RespackProblem, error) {
+	library := make(map[string]RespackMeta)
+	if err := readJSONFile(filepath.Join(respackDir, libraryMetaFile), &library); err != nil {
+		return nil, nil, err
+	}
+	metas := make(map[string]*RespackMeta, len(respacks))
+	problems := make(map[string]*RespackProblem)
+	for _, respack := range respacks {
+		meta := library[respack.ID]
+		if respack.filename != "" {
+			var sidecar RespackMeta
+			sidecarFile := strings.TrimSuffix(respack.filename, filepath.Ext(respack.filename)) + ".json"
+			if err := readJSONFile(sidecarFile, &sidecar); err != nil {
+				problems[respack.ID] = &RespackProblem{Message: err.Error()}
+			} else {
+				meta.merge(sidecar)
+			}
+		}
+		metas[respack.ID] = &meta
+	}
+	return metas, problems, nil
+}
+
+func readJSONFile(filename string, v any) error {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return errors.New(filepath.Base(filename) + ": " + err.Error())
+	}
+	return nil
+}
+
+func mergeNames(names, other []string) []string {
+	for _, name := range other {
+		name = strings.TrimSpace(name)
+		if name != "" && !containsFold(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Meta returns the tags and collections of the respack. The library replaces
+// them on rescans while the respack is being served.
+func (rp *Respack) Meta() RespackMeta {
+	if meta := rp.meta.Load(); meta != nil {
+		return *meta
+	}
+	return RespackMeta{}
+}
+
+func (rp *Respack) HasTag(tag string) bool {
+	return containsFold(rp.Meta().Tags, tag)
+}
+
+func (rp *Respack) InCollection(collection string) bool {
+	return containsFold(rp.Meta().Collections, collection)
+}
+
+func listTags(respacks []*Respack) []string {
+	var tags []string
+	for _, rp := range respacks {
+		tags = mergeNames(tags, rp.Meta().Tags)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return strings.ToLower(tags[i]) < strings.ToLower(tags[j])
+	})
+	return tags
+}
+
+func filterCollection(respacks []*Respack, collection string) (results []*Respack) {
+	for _, rp := range respacks {
+		if rp.InCollection(collection) {
+			results = append(results, rp)
+		}
+	}
+	return
+}
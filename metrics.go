@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+type cacheKey struct {
+	cache string
+	hit   bool
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Metrics collects the request, traffic and cache counters exposed in the
+// Prometheus text format. The library gauges are read at each scrape.
+type Metrics struct {
+	mtx       sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+	bytes     map[string]uint64
+	cache     map[cacheKey]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[string]*histogram),
+		bytes:     make(map[string]uint64),
+		cache:     make(map[cacheKey]uint64),
+	}
+}
+
+// Middleware counts the requests and their latency per chi route pattern.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		m.observeRequest(requestKey{method: r.Method, route: routePattern(r), code: rec.Status()}, time.Since(start))
+	})
+}
+
+// routePattern returns the pattern of the route that handled the request,
+// including the base path the app router is mounted under.
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || len(rctx.RoutePatterns) < 2 {
+		return "unmatched"
+	}
+	pattern := strings.Join(rctx.RoutePatterns, "")
+	for strings.Contains(pattern, "/*/") {
+		pattern = strings.ReplaceAll(pattern, "/*/", "/")
+	}
+	return pattern
+}
+
+func (m *Metrics) observeRequest(key requestKey, d time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.requests[key]++
+	h, ok := m.latencies[key.route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[key.route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// AddRespackBytes counts the bytes of respack resources served. Virtual
+// respacks are counted per kind to keep the number of series bounded.
+func (m *Metrics) AddRespackBytes(respackID string, n int64) {
+	if kind, _, err := parseVirtualRespackID(respackID); err == nil {
+		respackID = virtualRespackPrefix + kind
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.bytes[respackID] += uint64(n)
+}
+
+// CacheResult counts a lookup in the named cache.
+func (m *Metrics) CacheResult(cache string, hit bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.cache[cacheKey{cache: cache, hit: hit}]++
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer, library *Library) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	writeHeader(w, "hues_http_requests_total", "counter", "HTTP requests by route and status code.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, key := range requests {
+		writeSample(w, "hues_http_requests_total", m.requests[key],
+			"method", key.method, "route", key.route, "code", strconv.Itoa(key.code))
+	}
+
+	writeHeader(w, "hues_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range sortedKeys(m.latencies) {
+		h := m.latencies[route]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			writeSample(w, "hues_http_request_duration_seconds_bucket", cumulative,
+				"route", route, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		writeSample(w, "hues_http_request_duration_seconds_bucket", h.count, "route", route, "le", "+Inf")
+		writeSample(w, "hues_http_request_duration_seconds_sum", h.sum, "route", route)
+		writeSample(w, "hues_http_request_duration_seconds_count", h.count, "route", route)
+	}
+
+	writeHeader(w, "hues_respack_bytes_total", "counter", "Bytes of respack resources served.")
+	for _, respackID := range sortedKeys(m.bytes) {
+		writeSample(w, "hues_respack_bytes_total", m.bytes[respackID], "respack", respackID)
+	}
+
+	writeHeader(w, "hues_cache_requests_total", "counter", "Cache lookups by cache and result.")
+	caches := make([]cacheKey, 0, len(m.cache))
+	for key := range m.cache {
+		caches = append(caches, key)
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].cache < caches[j].cache || (caches[i].cache == caches[j].cache && caches[i].hit)
+	})
+	for _, key := range caches {
+		result := "miss"
+		if key.hit {
+			result = "hit"
+		}
+		writeSample(w, "hues_cache_requests_total", m.cache[key], "cache", key.cache, "result", result)
+	}
+
+	writeHeader(w, "hues_zip_archives_open", "gauge", "Open respack ZIP archives.")
+	writeSample(w, "hues_zip_archives_open", openZipArchives.Load())
+	writeHeader(w, "hues_zip_readers_open", "gauge", "Open readers of files in respack ZIP archives.")
+	writeSample(w, "hues_zip_readers_open", openZipReaders.Load())
+
+	status := library.Status()
+	writeHeader(w, "hues_respacks_loaded", "gauge", "Served respacks.")
+	writeSample(w, "hues_respacks_loaded", status.Respacks)
+	writeHeader(w, "hues_songs_loaded", "gauge", "Songs of the served respacks.")
+	writeSample(w, "hues_songs_loaded", status.Songs)
+	writeHeader(w, "hues_images_loaded", "gauge", "Images of the served respacks.")
+	writeSample(w, "hues_images_loaded", status.Images)
+	writeHeader(w, "hues_respack_load_failures", "gauge", "Respack files that failed to load.")
+	writeSample(w, "hues_respack_load_failures", len(status.Failures))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample with its labels given as name-value pairs.
+func writeSample(w io.Writer, name string, value any, labels ...string) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(labels[i] + `="` + labelValueEscaper.Replace(labels[i+1]) + `"`)
+		}
+		sb.WriteByte('}')
+	}
+	fmt.Fprintf(w, "%s %v\n", sb.String(), value)
+}
+
+// statusRecorder remembers the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Status returns the status code of the response, 200 if nothing was written.
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
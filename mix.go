@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type mixItem struct {
+	RespackID string
+	Name      string
+}
+
+func parseMixItem(s string) (mixItem, error) {
+	respackID, name, ok := strings.Cut(s, "/")
+	if !ok || respackID == "" || name == "" {
+		return mixItem{}, fmt.Errorf("invalid mix item (expected respack/name): %s", s)
+	}
+	return mixItem{RespackID: respackID, Name: name}, nil
+}
+
+func (item mixItem) String() string {
+	return item.RespackID + "/" + item.Name
+}
+
+// Mix is a selection of individual songs and images taken from any number of
+// respacks.
+type Mix struct {
+	Songs  []mixItem
+	Images []mixItem
+}
+
+func parseMix(params url.Values) (*Mix, error) {
+	mix := &Mix{}
+	for _, s := range params["songs"] {
+		item, err := parseMixItem(s)
+		if err != nil {
+			return nil, err
+		}
+		mix.Songs = append(mix.Songs, item)
+	}
+	for _, s := range params["images"] {
+		item, err := parseMixItem(s)
+		if err != nil {
+			return nil, err
+		}
+		mix.Images = append(mix.Images, item)
+	}
+	if len(mix.Songs) == 0 && len(mix.Images) == 0 {
+		return nil, fmt.Errorf("empty mix")
+	}
+	return mix, nil
+}
+
+func (mix *Mix) Values() url.Values {
+	params := make(url.Values)
+	for _, item := range mix.Songs {
+		params.Add("songs", item.String())
+	}
+	for _, item := range mix.Images {
+		params.Add("images", item.String())
+	}
+	return params
+}
+
+func (mix *Mix) ID() string {
+	return virtualRespackID("mix", mix.Values())
+}
+
+func (mix *Mix) Respack(lookup respackLookup) (*Respack, error) {
+	rp := newVirtualRespack(mix.ID(), "Custom mix")
+	for _, item := range mix.Songs {
+		song, err := findMixSong(item, lookup)
+		if err != nil {
+			return nil, err
+		}
+		rp.Songs.Song = append(rp.Songs.Song, song)
+	}
+	for _, item := range mix.Images {
+		image, err := findMixImage(item, lookup)
+		if err != nil {
+			return nil, err
+		}
+		rp.Images.Image = append(rp.Images.Image, image)
+	}
+	if err := rp.mountVirtualXMLs(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+func findMixSong(item mixItem, lookup respackLookup) (Song, error) {
+	respack, ok := lookup(item.RespackID)
+	if !ok {
+		return Song{}, fmt.Errorf("unknown respack: %s", item.RespackID)
+	}
+	for _, song := range respack.Songs.Song {
+		if song.Name == item.Name {
+			song.Source = respackResourceSource(respack.ID, song.Name)
+			if song.Buildup != "" {
+				song.BuildupSource = respackResourceSource(respack.ID, song.Buildup)
+			}
+			return song, nil
+		}
+	}
+	return Song{}, fmt.Errorf("unknown song: %s", item)
+}
+
+func findMixImage(item mixItem, lookup respackLookup) (Image, error) {
+	respack, ok := lookup(item.RespackID)
+	if !ok {
+		return Image{}, fmt.Errorf("unknown respack: %s", item.RespackID)
+	}
+	for _, image := range respack.Images.Image {
+		if image.Name == item.Name {
+			image.Source = respackResourceSource(respack.ID, image.Name)
+			return image, nil
+		}
+	}
+	return Image{}, fmt.Errorf("unknown image: %s", item)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPaletteColors = 8
+	maxPaletteColors     = 64
+	paletteMaxImages     = 64
+	paletteSamples       = 4096 // per image
+	// paletteCacheRespacks is the number of respacks whose sampled pixels are
+	// kept, about 1 MiB each.
+	paletteCacheRespacks = 16
+	paletteCacheSize     = 256
+)
+
+var (
+	palettePixels = newMemoryCache[[]color.RGBA](paletteCacheRespacks)
+	paletteCache  = newMemoryCache[[]Hue](paletteCacheSize)
+	// paletteExtractions limits the number of respacks whose images are
+	// sampled at once, on top of imageRenders, so that palettes of many
+	// respacks requested together don't hold up the thumbnails.
+	paletteExtractions = make(chan struct{}, 2)
+)
+
+// parsePaletteColors returns the number of colors of a palette, 0 if the
+// palette is off.
+func parsePaletteColors(value string) (int, error) {
+	if colors, err := strconv.Atoi(value); err == nil {
+		if colors >= 1 && colors <= maxPaletteColors {
+			return colors, nil
+		}
+	} else if on, err := strconv.ParseBool(value); err == nil {
+		if on {
+			return defaultPaletteColors, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid palette: %s (expected true, false or 1-%d colors)", value, maxPaletteColors)
+}
+
+// samplePixels appends about paletteSamples evenly spread pixels of the
+// image to pixels. Mostly transparent pixels are skipped.
+func samplePixels(img image.Image, pixels []color.RGBA) []color.RGBA {
+	bounds := img.Bounds()
+	step := int(math.Max(1, math.Ceil(math.Sqrt(float64(bounds.Dx()*bounds.Dy())/paletteSamples))))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= 0x80 {
+				pixels = append(pixels, color.RGBA{R: c.R, G: c.G, B: c.B, A: 0xff})
+			}
+		}
+	}
+	return pixels
+}
+
+func colorChannel(c color.RGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+type colorBox []color.RGBA
+
+// widestChannel returns the channel with the largest range of values.
+func (box colorBox) widestChannel() (channel int, width int) {
+	for ch := 0; ch < 3; ch++ {
+		lo, hi := uint8(0xff), uint8(0)
+		for _, c := range box {
+			v := colorChannel(c, ch)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if int(hi)-int(lo) > width {
+			channel, width = ch, int(hi)-int(lo)
+		}
+	}
+	return channel, width
+}
+
+func (box colorBox) mean() color.RGBA {
+	var r, g, b int
+	for _, c := range box {
+		r, g, b = r+int(c.R), g+int(c.G), b+int(c.B)
+	}
+	n := len(box)
+	return color.RGBA{R: uint8((r + n/2) / n), G: uint8((g + n/2) / n), B: uint8((b + n/2) / n), A: 0xff}
+}
+
+// medianCut quantizes the pixels to at most n colors by splitting the box
+// with the widest range of colors at its median until there are n boxes.
+// The colors are ordered from the most to the least common.
+func medianCut(pixels []color.RGBA, n int) []color.RGBA {
+	boxes := []colorBox{pixels}
+	for len(boxes) < n {
+		best, bestChannel, bestWidth := -1, 0, 0
+		for i, box := range boxes {
+			if channel, width := box.widestChannel(); width > bestWidth {
+				best, bestChannel, bestWidth = i, channel, width
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool {
+			return colorChannel(box[i], bestChannel) < colorChannel(box[j], bestChannel)
+		})
+		// split between different values, so that the halves don't overlap
+		median := colorChannel(box[len(box)/2], bestChannel)
+		split := sort.Search(len(box), func(i int) bool {
+			return colorChannel(box[i], bestChannel) >= median
+		})
+		if split == 0 {
+			split = sort.Search(len(box), func(i int) bool {
+				return colorChannel(box[i], bestChannel) > median
+			})
+		}
+		boxes = append(boxes, box[split:])
+		boxes[best] = box[:split]
+	}
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i]) > len(boxes[j])
+	})
+	colors := make([]color.RGBA, len(boxes))
+	for i, box := range boxes {
+		colors[i] = box.mean()
+	}
+	return colors
+}
+
+// respackPixels samples the pixels of the images of the respacks.
+func respackPixels(respacks []*Respack, lookup respackLookup) []color.RGBA {
+	var pixels []color.RGBA
+	images := 0
+	for _, respack := range respacks {
+		for _, img := range respack.Images.Image {
+			if images >= paletteMaxImages {
+				break
+			}
+			acquireImageRender()
+			if decoded, ok := decodeRespackImage(img, lookup); ok {
+				pixels = samplePixels(decoded, pixels)
+				images++
+			}
+			releaseImageRender()
+		}
+	}
+	return pixels
+}
+
+// extractPalette quantizes the colors of the images of the respacks into a
+// palette, named after the closest CSS colors.
+func extractPalette(respacks []*Respack, lookup respackLookup, n int) ([]Hue, error) {
+	pixels := respackPixels(respacks, lookup)
+	if len(pixels) == 0 {
+		return nil, errors.New("no opaque pixels in the images")
+	}
+	return paletteHues(pixels, n), nil
+}
+
+// respackPalette returns the palette of a library respack, extracting it on
+// the first request. The sampled pixels are kept for the other sizes.
+func respackPalette(respack *Respack, lookup respackLookup, n int) ([]Hue, error) {
+	respackKey := respacksCacheKey([]*Respack{respack})
+	key := respackKey + ":" + strconv.Itoa(n)
+	if hues, ok := paletteCache.Get(key); ok {
+		return hues, nil
+	}
+	pixels, ok := palettePixels.Get(respackKey)
+	if !ok {
+		paletteExtractions <- struct{}{}
+		// another request may have sampled them while this one waited
+		if pixels, ok = palettePixels.Get(respackKey); !ok {
+			pixels = respackPixels([]*Respack{respack}, lookup)
+			palettePixels.Add(respackKey, pixels)
+		}
+		<-paletteExtractions
+	}
+	if len(pixels) == 0 {
+		return nil, errors.New("no opaque pixels in the images")
+	}
+	// medianCut reorders the pixels
+	hues := paletteHues(append([]color.RGBA(nil), pixels...), n)
+	paletteCache.Add(key, hues)
+	return hues, nil
+}
+
+func paletteHues(pixels []color.RGBA, n int) []Hue {
+	hues := make([]Hue, 0, n)
+	names := make(map[string]int)
+	for _, c := range medianCut(pixels, n) {
+		name := nearestColorName(c)
+		if names[name]++; names[name] > 1 {
+			name += " " + strconv.Itoa(names[name])
+		}
+		hues = append(hues, Hue{Name: name, Color: cssColor(c)})
+	}
+	return hues
+}
+
+// paletteRespackID returns the ID of a virtual respack with the palette
+// extracted from the images of a library respack.
+func paletteRespackID(respackID string, colors int) string {
+	return virtualRespackID("palette", url.Values{"respack": {respackID}, "colors": {strconv.Itoa(colors)}})
+}
+
+// paletteSource returns the library respack the first image of the player
+// comes from, which the palette option extracts the hues of.
+func paletteSource(respacks []*Respack) (string, bool) {
+	for _, respack := range respacks {
+		for _, img := range respack.Images.Image {
+			if respackID, _, ok := strings.Cut(img.URI, "/"); ok && !isVirtualRespackID(respackID) {
+				return respackID, true
+			}
+		}
+	}
+	return "", false
+}
+
+func paletteRespack(params url.Values, lookup respackLookup) (*Respack, error) {
+	colors, err := parsePaletteColors(params.Get("colors"))
+	if err != nil {
+		return nil, err
+	}
+	if colors == 0 {
+		return nil, errors.New("no palette colors")
+	}
+	respackID := params.Get("respack")
+	respack, ok := lookup(respackID)
+	if !ok {
+		return nil, fmt.Errorf("unknown respack: %s", respackID)
+	}
+	if respack.filename == "" {
+		return nil, fmt.Errorf("palettes are only extracted from library respacks: %s", respackID)
+	}
+	hues, err := respackPalette(respack, lookup, colors)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := newVirtualRespack(paletteRespackID(respackID, colors), respack.Name()+" (palette)")
+	rp.Hues.Hue = hues
+	if err := rp.mountVirtualXMLs(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// paletteCommand writes the hues.xml of the palette extracted from respack
+// files.
+func paletteCommand(args []string) error {
+	flags := flag.NewFlagSet("palette", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: 0x40hues palette [-colors N] [-o hues.xml] respack.zip...")
+		flags.PrintDefaults()
+	}
+	colors := flags.Int("colors", defaultPaletteColors, fmt.Sprintf("Number of colors (1-%d)", maxPaletteColors))
+	output := flags.String("o", "", "Output file (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no respack file")
+	}
+	if *colors < 1 || *colors > maxPaletteColors {
+		return fmt.Errorf("invalid number of colors: %d", *colors)
+	}
+
+	loaded := make(map[string]*Respack)
+	var respacks []*Respack
+	for _, filename := range flags.Args() {
+		respack, err := LoadRespackZIP(filename)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		defer respack.Close()
+		loaded[respack.ID] = respack
+		respacks = append(respacks, respack)
+	}
+	lookup := func(id string) (*Respack, bool) {
+		respack, ok := loaded[id]
+		return respack, ok
+	}
+	hues, err := extractPalette(respacks, lookup, *colors)
+	if err != nil {
+		return err
+	}
+
+	var palette Respack
+	palette.Hues.Hue = hues
+	content, err := xml.MarshalIndent(&palette.Hues, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(append([]byte(xml.Header), content...), '\n')
+	if *output != "" {
+		return os.WriteFile(*output, content, 0644)
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
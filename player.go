@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type huesConfig struct {
+	Respacks     []string `json:"respack"`
+	DefaultSong  int      `json:"defaultSong"`
+	DefaultImage *int     `json:"defaultImage,omitempty"`
+	DefaultHue   *int     `json:"defaultHue,omitempty"`
+	Hues         string   `json:"hues,omitempty"`
+	AutoMode     string   `json:"autoMode,omitempty"`
+	TrippyMode   bool     `json:"trippyMode,omitempty"`
+	AutoPlay     bool     `json:"autoPlay"`
+	Muted        bool     `json:"muted,omitempty"`
+	HideUI       bool     `json:"hideUI,omitempty"`
+}
+
+// playerView is the data of the player page.
+type playerView struct {
+	Config      *huesConfig
+	Title       string
+	Description string
+	Preview     string // preview image path relative to the base path, if there is one
+	OEmbed      string // oEmbed discovery URL, empty if embedding is disabled
+}
+
+var errNotFound = errors.New("not found")
+
+var autoModes = map[string]string{
+	"normal":    "normal",
+	"auto":      "auto",
+	"full":      "full auto",
+	"full auto": "full auto",
+	"full-auto": "full auto",
+}
+
+// newHuesConfig builds the player configuration for the given respacks from
+// the query parameters of the request.
+func newHuesConfig(query url.Values, respacks []*Respack, lookup respackLookup, palettes *PaletteLibrary) (*huesConfig, error) {
+	config := &huesConfig{AutoPlay: true}
+	var songs, images, hues int
+	for _, respack := range respacks {
+		config.Respacks = append(config.Respacks, respack.ID)
+		songs += respack.SongCount()
+		images += respack.ImageCount()
+		hues += len(respack.Hues.Hue)
+	}
+	if images == 0 {
+		respacks = append(respacks, builtinImgR)
+		config.Respacks = append(config.Respacks, builtinImgR.ID)
+		images = builtinImgR.ImageCount()
+	}
+	if hues == 0 {
+		hues = len(builtinR.Hues.Hue)
+	}
+
+	if lite := query.Get("lite"); lite != "" {
+		height, err := parseLiteOption(lite)
+		if err != nil {
+			return nil, err
+		}
+		if height > 0 {
+			for i, respackID := range config.Respacks {
+				config.Respacks[i] = liteRespackID(respackID, height)
+			}
+		}
+	}
+
+	hueset, set := query.Get("hues"), query.Get("set")
+	if _, ok := lookup(hueset); hueset != "" && set == "" && !ok {
+		respack, err := findCustomHues(hueset, palettes)
+		if err != nil {
+			return nil, err
+		}
+		config.Hues = respack.ID
+		hues = len(respack.Hues.Hue)
+	} else if hueset != "" || set != "" {
+		if hueset == "" {
+			var err error
+			if hueset, err = findHueSet(respacks, set); err != nil {
+				return nil, err
+			}
+		}
+		params := url.Values{"respack": {hueset}}
+		if set != "" {
+			params.Set("set", set)
+		}
+		respack, err := huesRespack(params, lookup)
+		if err != nil {
+			return nil, err
+		}
+		config.Hues = respack.ID
+		hues = len(respack.Hues.Hue)
+	}
+	if palette := query.Get("palette"); palette != "" {
+		colors, err := parsePaletteColors(palette)
+		if err != nil {
+			return nil, err
+		}
+		if colors > 0 {
+			if config.Hues != "" {
+				return nil, errors.New("hues and palette can't be used together")
+			}
+			respackID, ok := paletteSource(respacks)
+			if !ok {
+				return nil, errors.New("palette needs a respack with images")
+			}
+			respack, err := paletteRespack(url.Values{"respack": {respackID}, "colors": {strconv.Itoa(colors)}}, lookup)
+			if err != nil {
+				return nil, err
+			}
+			config.Hues = respack.ID
+			hues = len(respack.Hues.Hue)
+		}
+	}
+
+	var err error
+	// items are looked up by name first, so that a song called "1999" can be
+	// picked, and then by index
+	if song := query.Get("song"); song != "" {
+		config.DefaultSong, err = findSongIndex(respacks, song)
+		if errors.Is(err, errNotFound) && isIndex(song) {
+			config.DefaultSong, err = parseIndexOption("song", song, songs, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if image := query.Get("image"); image != "" {
+		index, err := findImageIndex(respacks, image)
+		if errors.Is(err, errNotFound) && isIndex(image) {
+			index, err = parseIndexOption("image", image, images, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+		config.DefaultImage = &index
+	}
+	if hue := query.Get("hue"); hue != "" {
+		index, err := parseIndexOption("hue", hue, hues, true)
+		if err != nil {
+			return nil, err
+		}
+		config.DefaultHue = &index
+	}
+	if autoMode := query.Get("autoMode"); autoMode != "" {
+		var ok bool
+		if config.AutoMode, ok = autoModes[strings.ToLower(autoMode)]; !ok {
+			return nil, fmt.Errorf("invalid autoMode: %s (expected normal, auto or full)", autoMode)
+		}
+	}
+	if trippy := query.Get("trippy"); trippy != "" {
+		if config.TrippyMode, err = parseBoolOption("trippy", trippy); err != nil {
+			return nil, err
+		}
+	}
+	if autoPlay := query.Get("autoplay"); autoPlay != "" {
+		if config.AutoPlay, err = parseBoolOption("autoplay", autoPlay); err != nil {
+			return nil, err
+		}
+	}
+	if muted := query.Get("muted"); muted != "" {
+		if config.Muted, err = parseBoolOption("muted", muted); err != nil {
+			return nil, err
+		}
+	}
+	if hideUI := query.Get("hideUI"); hideUI != "" {
+		if config.HideUI, err = parseBoolOption("hideUI", hideUI); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func isIndex(value string) bool {
+	_, err := strconv.Atoi(value)
+	return err == nil
+}
+
+func parseIndexOption(name, value string, count int, allowRandom bool) (int, error) {
+	index, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s (expected a number)", name, value)
+	}
+	if allowRandom && index == -1 {
+		return index, nil
+	}
+	switch {
+	case count == 0 && index == 0:
+		// the default of the player, whether or not there is anything
+		return index, nil
+	case count == 0:
+		return 0, fmt.Errorf("invalid %s: %d (there are no %ss)", name, index, name)
+	case index < 0 || index >= count:
+		return 0, fmt.Errorf("invalid %s: %d (out of range 0-%d)", name, index, count-1)
+	}
+	return index, nil
+}
+
+func parseBoolOption(name, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s (expected true or false)", name, value)
+	}
+	return b, nil
+}
+
+// findSongIndex returns the position of a song in the player's song list.
+// The song is referred to by its name or title, optionally qualified with
+// the respack ID (e.g. "respack/song").
+func findSongIndex(respacks []*Respack, ref string) (int, error) {
+	index := 0
+	respackID, name := splitItemRef(respacks, ref)
+	for _, respack := range respacks {
+		if respackID != "" && respack.ID != respackID {
+			index += respack.SongCount()
+			continue
+		}
+		for _, song := range respack.Songs.Song {
+			if strings.EqualFold(song.Name, name) || strings.EqualFold(song.Title, name) {
+				return index, nil
+			}
+			index++
+		}
+	}
+	return 0, fmt.Errorf("song %w: %s", errNotFound, ref)
+}
+
+// findImageIndex is the same as findSongIndex, but for images referred to by
+// their name or full name.
+func findImageIndex(respacks []*Respack, ref string) (int, error) {
+	index := 0
+	respackID, name := splitItemRef(respacks, ref)
+	for _, respack := range respacks {
+		if respackID != "" && respack.ID != respackID {
+			index += respack.ImageCount()
+			continue
+		}
+		for _, image := range respack.Images.Image {
+			if strings.EqualFold(image.Name, name) || strings.EqualFold(image.FullName, name) {
+				return index, nil
+			}
+			index++
+		}
+	}
+	return 0, fmt.Errorf("image %w: %s", errNotFound, ref)
+}
+
+func splitItemRef(respacks []*Respack, ref string) (respackID, name string) {
+	if respackID, name, ok := strings.Cut(ref, "/"); ok {
+		for _, respack := range respacks {
+			if respack.ID == respackID {
+				return respackID, name
+			}
+		}
+	}
+	return "", ref
+}
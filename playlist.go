@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type playlistTrack struct {
+	URI      string // relative to the respacks path, like Song.URI
+	Title    string
+	Duration time.Duration // 0 if unknown
+}
+
+// playlistTracks lists the songs of the respack, each one preceded by its
+// buildup.
+func playlistTracks(respack *Respack) []playlistTrack {
+	var tracks []playlistTrack
+	for _, song := range respack.Songs.Song {
+		title := song.Title
+		if title == "" {
+			title = song.Name
+		}
+		if song.BuildupURI != "" {
+			tracks = append(tracks, playlistTrack{
+				URI:      song.BuildupURI,
+				Title:    title + " (buildup)",
+				Duration: song.BuildupDuration,
+			})
+		}
+		if song.URI != "" {
+			tracks = append(tracks, playlistTrack{
+				URI:      song.URI,
+				Title:    title,
+				Duration: song.Duration,
+			})
+		}
+	}
+	return tracks
+}
+
+// escapeURI escapes the path segments of a respack resource URI.
+func escapeURI(uri string) string {
+	segments := strings.Split(uri, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// renderM3U writes an extended M3U playlist. The base URL is prepended to
+// the track URIs.
+func renderM3U(title string, tracks []playlistTrack, baseURL string) []byte {
+	line := strings.NewReplacer("\r", " ", "\n", " ")
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&buf, "#PLAYLIST:%s\n", line.Replace(title))
+	for _, track := range tracks {
+		seconds := -1
+		if track.Duration > 0 {
+			seconds = int(track.Duration.Round(time.Second) / time.Second)
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", seconds, line.Replace(track.Title), baseURL+escapeURI(track.URI))
+	}
+	return buf.Bytes()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Creator string      `xml:"creator,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+// renderXSPF writes an XSPF playlist, the same as renderM3U.
+func renderXSPF(title, creator string, tracks []playlistTrack, baseURL string) ([]byte, error) {
+	playlist := xspfPlaylist{Version: 1, Title: title, Creator: creator}
+	for _, track := range tracks {
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{
+			Location: baseURL + escapeURI(track.URI),
+			Title:    track.Title,
+			Duration: track.Duration.Milliseconds(),
+		})
+	}
+	content, err := xml.MarshalIndent(&playlist, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), content...), '\n'), nil
+}
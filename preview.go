@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	previewWidth   = 1200
+	previewHeight  = 630
+	previewMargin  = 40
+	previewCaption = 120
+)
+
+var previewFont = must(loadGlyphSheet(must(assets.ReadFile("assets/fonts/PetMe64.png"))))
+
+// previewHue picks one of the hues of the respacks, the same one for the
+// same key. Black is skipped as the caption would disappear on it.
+func previewHue(key string, respacks []*Respack) color.RGBA {
+	var colors []color.RGBA
+	for _, respack := range append(respacks, builtinR) {
+		for _, hue := range respack.Hues.Hue {
+			if c, ok := parseHueColor(hue.Color); ok && c != (color.RGBA{A: 0xff}) {
+				colors = append(colors, c)
+			}
+		}
+		if len(colors) > 0 {
+			break
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
+
+// previewImage decodes the first image of the respacks.
+func previewImage(respacks []*Respack, lookup respackLookup) (image.Image, bool) {
+	for _, respack := range respacks {
+		for _, img := range respack.Images.Image {
+			if decoded, ok := decodeRespackImage(img, lookup); ok {
+				return decoded, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// decodeRespackImage decodes an image, or the first frame of an animation,
+// unless it's larger than thumbnails can be. Images of mixes are read from
+// the respack they come from.
+func decodeRespackImage(img Image, lookup respackLookup) (image.Image, bool) {
+	respackID, filename, ok := strings.Cut(img.URI, "/")
+	if !ok {
+		return nil, false
+	}
+	source, ok := lookup(respackID)
+	if !ok {
+		return nil, false
+	}
+	f, err := source.Open(path.Base(filename))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > thumbnailMaxPixels {
+		return nil, false
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	return decoded, err == nil
+}
+
+// renderPreview draws the preview card of a player: the first image over
+// one of the hues, with the title in a caption at the bottom.
+func renderPreview(key, title string, respacks []*Respack, lookup respackLookup) ([]byte, error) {
+	acquireImageRender()
+	defer releaseImageRender()
+	img := image.NewRGBA(image.Rect(0, 0, previewWidth, previewHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{previewHue(key, respacks)}, image.Point{}, draw.Src)
+
+	if src, ok := previewImage(respacks, lookup); ok {
+		bounds := src.Bounds()
+		width, height := fitSize(bounds.Dx(), bounds.Dy(),
+			previewWidth-2*previewMargin, previewHeight-previewCaption-2*previewMargin, true)
+		x := (previewWidth - width) / 2
+		y := previewMargin + (previewHeight-previewCaption-2*previewMargin-height)/2
+		draw.Draw(img, image.Rect(x, y, x+width, y+height), resizeImage(src, width, height), image.Point{}, draw.Over)
+	}
+
+	caption := image.Rect(0, previewHeight-previewCaption, previewWidth, previewHeight)
+	draw.Draw(img, caption, &image.Uniform{color.NRGBA{A: 0xc0}}, image.Point{}, draw.Over)
+	scale, text := previewTitle(title)
+	textWidth := len([]rune(text)) * bitmapFontSize * scale
+	previewFont.drawText(img, (previewWidth-textWidth)/2, caption.Min.Y+(previewCaption-bitmapFontSize*scale)/2,
+		scale, text, color.White)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// previewTitle returns the largest font scale the title fits with, shortening
+// the title if it doesn't fit even with the smallest one.
+func previewTitle(title string) (int, string) {
+	runes := []rune(title)
+	for scale := 6; scale >= 3; scale-- {
+		if len(runes)*bitmapFontSize*scale <= previewWidth-2*previewMargin {
+			return scale, title
+		}
+	}
+	max := (previewWidth - 2*previewMargin) / (bitmapFontSize * 3)
+	return 3, string(runes[:max-3]) + "..."
+}
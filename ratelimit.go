@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const rateLimitPruneInterval = time.Minute
+
+// RateLimit is the budget of a client for a class of respack resources. Zero
+// values mean no limit. The bandwidth burst is one second worth of bandwidth.
+type RateLimit struct {
+	Requests  float64 `json:"requests"`  // per second
+	Burst     int     `json:"burst"`     // requests
+	Bandwidth int64   `json:"bandwidth"` // bytes per second
+}
+
+func (limit RateLimit) enabled() bool {
+	return limit.Requests > 0 || limit.Bandwidth > 0
+}
+
+func (limit RateLimit) requestBurst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, limit.Requests)
+}
+
+type RespackLimits struct {
+	XML       RateLimit `json:"xml"`
+	Media     RateLimit `json:"media"`
+	Allowlist []string  `json:"allowlist"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last update.
+func (b *tokenBucket) refill(rate, burst float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+type clientBuckets struct {
+	limit     RateLimit
+	requests  tokenBucket
+	bandwidth tokenBucket
+}
+
+// idleTime is how long the client has to be idle for its buckets to be full
+// again, so they can be dropped.
+func (b *clientBuckets) idleTime() time.Duration {
+	idle := rateLimitPruneInterval
+	if b.limit.Requests > 0 {
+		refill := time.Duration(b.limit.requestBurst() / b.limit.Requests * float64(time.Second))
+		if refill > idle {
+			idle = refill
+		}
+	}
+	return idle
+}
+
+// RateLimiter limits the request rate and the bandwidth of each client IP
+// address, separately for respack XMLs and media files.
+type RateLimiter struct {
+	mtx       sync.Mutex
+	xml       RateLimit
+	media     RateLimit
+	allowlist []*net.IPNet
+	clients   map[string]*clientBuckets
+	lastPrune time.Time
+}
+
+func NewRateLimiter(limits RespackLimits) (*RateLimiter, error) {
+	allowlist, err := parseIPNets(limits.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{
+		xml:       limits.XML,
+		media:     limits.Media,
+		allowlist: allowlist,
+		clients:   make(map[string]*clientBuckets),
+	}, nil
+}
+
+// buckets returns the buckets of a client refilled up to now. The caller must
+// hold the lock.
+func (rl *RateLimiter) buckets(key string, limit RateLimit, now time.Time) *clientBuckets {
+	if now.Sub(rl.lastPrune) > rateLimitPruneInterval {
+		rl.prune(now)
+	}
+	b, ok := rl.clients[key]
+	if !ok {
+		b = &clientBuckets{limit: limit}
+		rl.clients[key] = b
+	}
+	b.requests.refill(limit.Requests, limit.requestBurst(), now)
+	b.bandwidth.refill(float64(limit.Bandwidth), float64(limit.Bandwidth), now)
+	return b
+}
+
+// prune drops the clients that haven't been seen for long enough to have
+// full buckets again.
+func (rl *RateLimiter) prune(now time.Time) {
+	for key, b := range rl.clients {
+		if now.Sub(b.requests.last) > b.idleTime() {
+			delete(rl.clients, key)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// allow takes a request token. It returns how long the client has to wait if
+// it ran out of requests or bandwidth.
+func (rl *RateLimiter) allow(key string, limit RateLimit) (time.Duration, bool) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	b := rl.buckets(key, limit, time.Now())
+	var wait float64
+	if limit.Requests > 0 && b.requests.tokens < 1 {
+		wait = (1 - b.requests.tokens) / limit.Requests
+	}
+	if limit.Bandwidth > 0 && b.bandwidth.tokens < 0 {
+		wait = math.Max(wait, -b.bandwidth.tokens/float64(limit.Bandwidth))
+	}
+	if wait > 0 {
+		return time.Duration(wait * float64(time.Second)), false
+	}
+	if limit.Requests > 0 {
+		b.requests.tokens--
+	}
+	return 0, true
+}
+
+// reserve takes n bytes of bandwidth and returns how long the client has to
+// wait before sending them.
+func (rl *RateLimiter) reserve(key string, limit RateLimit, n int) time.Duration {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	b := rl.buckets(key, limit, time.Now())
+	b.bandwidth.tokens -= float64(n)
+	if b.bandwidth.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.bandwidth.tokens / float64(limit.Bandwidth) * float64(time.Second))
+}
+
+// Middleware limits the requests of respack resources. Limited requests get
+// 429 with Retry-After, responses are slowed down to the bandwidth limit.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	if !rl.xml.enabled() && !rl.media.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, limit := "media", rl.media
+		if filepath.Ext(chi.URLParam(r, "*")) == ".xml" {
+			class, limit = "xml", rl.xml
+		}
+		rl.serve(w, r, next, class, limit)
+	})
+}
+
+// Limit returns a middleware limiting the requests of another class than the
+// respack resources, with the same allowlist.
+func (rl *RateLimiter) Limit(class string, limit RateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !limit.enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rl.serve(w, r, next, class, limit)
+		})
+	}
+}
+
+func (rl *RateLimiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler, class string, limit RateLimit) {
+	ip := clientIP(r)
+	if !limit.enabled() || containsIP(rl.allowlist, ip) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := class + " " + ip
+	if wait, ok := rl.allow(key, limit); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if limit.Bandwidth > 0 {
+		w = &throttledWriter{ResponseWriter: w, r: r, limiter: rl, key: key, limit: limit}
+	}
+	next.ServeHTTP(w, r)
+}
+
+// throttledWriter delays the writes of a response to keep the client within
+// its bandwidth.
+type throttledWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	limiter *RateLimiter
+	key     string
+	limit   RateLimit
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	if wait := tw.limiter.reserve(tw.key, tw.limit, len(p)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-tw.r.Context().Done():
+			return 0, tw.r.Context().Err()
+		}
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
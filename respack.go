@@ -4,14 +4,24 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// openZipArchives and openZipReaders count the open respack ZIP archives and
+// the open files inside them.
+var openZipArchives, openZipReaders atomic.Int64
+
 type XMLType int
 
 const (
@@ -33,60 +43,115 @@ type Respack struct {
 	}
 	Images struct {
 		XMLName xml.Name `xml:"images"`
-		Image   []struct {
-			URI           string `xml:"-"`
-			Name          string `xml:"name,attr"`
-			FullName      string `xml:"fullname,omitempty"`
-			CenterPixel   *int   `xml:"centerPixel,omitempty"`
-			Align         string `xml:"align,omitempty"`
-			FrameDuration *int   `xml:"frameDuration,omitempty"`
-			BeatsPerAnim  *int   `xml:"beatsPerAnim,omitempty"`
-		} `xml:"image"`
+		Image   []Image  `xml:"image"`
 	}
 	Songs struct {
 		XMLName xml.Name `xml:"songs"`
-		Song    []struct {
-			URI           string `xml:"-"`
-			Name          string `xml:"name,attr"`
-			Title         string `xml:"title,omitempty"`
-			Rhythm        string `xml:"rythm,omitempty"`
-			BuildupURI    string `xml:"-"`
-			Buildup       string `xml:"buildup,omitempty"`
-			BuildupRhythm string `xml:"buildupRhythm,omitempty"`
-			CharsPerBeat  *int   `xml:"charsPerBeat,omitempty"`
-		} `xml:"song"`
+		Song    []Song   `xml:"song"`
 	}
 	Hues struct {
 		XMLName xml.Name `xml:"hues"`
-		Hue     []struct {
-			Name  string `xml:"name,attr"`
-			Color string `xml:",chardata"`
-		} `xml:"hue"`
+		Hue     []Hue    `xml:"hue"`
 	}
 
+	meta        atomic.Pointer[RespackMeta] // replaced by the library on rescans
+	hueSets     []HueSet                    // every hue XML of the respack, the default one first
+	hueProblems []*RespackProblem           // hues with an invalid color
+
+	filename     string
+	modTime      time.Time
+	imageHeight  int // height images are scaled down to, 0 to serve them as is
 	fileHandlers map[string]func() (fs.File, error)
 	closer       io.Closer
+
+	closeMtx sync.Mutex
+	readers  int  // open files of the ZIP archive
+	closing  bool // the archive is closed when the last reader is done
+	closed   bool
+}
+
+type Image struct {
+	URI           string `xml:"-"`
+	Name          string `xml:"name,attr"`
+	Source        string `xml:"uri,omitempty"` // media location without extension, if not in the respack itself
+	FullName      string `xml:"fullname,omitempty"`
+	CenterPixel   *int   `xml:"centerPixel,omitempty"`
+	Align         string `xml:"align,omitempty"`
+	FrameDuration *int   `xml:"frameDuration,omitempty"`
+	BeatsPerAnim  *int   `xml:"beatsPerAnim,omitempty"`
+}
+
+type Song struct {
+	URI           string `xml:"-"`
+	Name          string `xml:"name,attr"`
+	Source        string `xml:"uri,omitempty"` // media location without extension, if not in the respack itself
+	Title         string `xml:"title,omitempty"`
+	Rhythm        string `xml:"rhythm,omitempty"`
+	BuildupURI    string `xml:"-"`
+	Buildup       string `xml:"buildup,omitempty"`
+	BuildupSource string `xml:"buildupUri,omitempty"`
+	BuildupRhythm string `xml:"buildupRhythm,omitempty"`
+	CharsPerBeat  *int   `xml:"charsPerBeat,omitempty"`
+
+	Duration        time.Duration `xml:"-"` // 0 if unknown
+	BuildupDuration time.Duration `xml:"-"`
+}
+
+// HueSet is the content of a hue XML, named after its file: "hues.xml" is
+// the default set and "hues-pastel.xml" is the pastel one.
+type HueSet struct {
+	XMLName xml.Name `xml:"hues"`
+	Name    string   `xml:"-"`
+	Hue     []Hue    `xml:"hue"`
+
+	file string // name the set is served as
+}
+
+const (
+	defaultHueSet    = "default"
+	fallbackHueColor = "#808080" // of hues with an invalid color
+)
+
+type Hue struct {
+	Name  string `xml:"name,attr"`
+	Color string `xml:",chardata"`
 }
 
 func LoadRespackZIP(filename string) (rp *Respack, err error) {
-	r, err := zip.OpenReader(filename)
+	// the archive is opened as a plain file so that uncompressed entries can
+	// be read at any offset
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	openZipArchives.Add(1)
 
 	defer func() {
-		if err != nil && rp != nil && rp.closer != nil {
-			rp.closer.Close()
+		if err != nil {
+			openZipArchives.Add(-1)
+			file.Close()
 		}
 	}()
 
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(file, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
 	rp = &Respack{
 		ID:           respackFilenameToID(filename),
+		filename:     filename,
+		modTime:      fi.ModTime(),
 		fileHandlers: make(map[string]func() (fs.File, error)),
-		closer:       r,
+		closer:       file,
 	}
 	rp.Info.Name = rp.ID
 
+	files := make(map[string]*zip.File)
 	for _, f := range r.File {
 		if f.FileInfo().IsDir() {
 			continue
@@ -100,12 +165,21 @@ func LoadRespackZIP(filename string) (rp *Respack, err error) {
 			basename := filepath.Base(f.Name)
 			f := f
 			rp.fileHandlers[basename] = func() (fs.File, error) {
-				return newFileWrapper(f)
+				return rp.openZipFile(f)
 			}
+			files[basename] = f
 		}
 	}
 
+	if err := rp.initHueSets(); err != nil {
+		return nil, err
+	}
 	rp.resolveURIs()
+	for i := range rp.Songs.Song {
+		song := &rp.Songs.Song[i]
+		song.Duration = zipAudioDuration(file, files[strings.TrimPrefix(song.URI, rp.ID+"/")])
+		song.BuildupDuration = zipAudioDuration(file, files[strings.TrimPrefix(song.BuildupURI, rp.ID+"/")])
+	}
 
 	return rp, nil
 }
@@ -118,10 +192,44 @@ func LoadRespackFS(root fs.FS, path string) (*Respack, error) {
 	if err := rp.loadFSDir(root, path); err != nil {
 		return nil, err
 	}
+	if err := rp.initHueSets(); err != nil {
+		return nil, err
+	}
 	rp.resolveURIs()
 	return rp, nil
 }
 
+func newVirtualRespack(id, name string) *Respack {
+	rp := &Respack{
+		ID:           id,
+		fileHandlers: make(map[string]func() (fs.File, error)),
+	}
+	rp.Info.Name = name
+	return rp
+}
+
+func (rp *Respack) mountVirtualXMLs() error {
+	if err := rp.mountXML("info.xml", &rp.Info); err != nil {
+		return err
+	}
+	if len(rp.Images.Image) > 0 {
+		if err := rp.mountXML("images.xml", &rp.Images); err != nil {
+			return err
+		}
+	}
+	if len(rp.Songs.Song) > 0 {
+		if err := rp.mountXML("songs.xml", &rp.Songs); err != nil {
+			return err
+		}
+	}
+	if len(rp.Hues.Hue) > 0 {
+		if err := rp.mountXML("hues.xml", &rp.Hues); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (rp *Respack) loadFSDir(root fs.FS, path string) error {
 	dirEntries, err := fs.ReadDir(root, path)
 	if err != nil {
@@ -153,10 +261,13 @@ func (rp *Respack) loadFSDir(root fs.FS, path string) error {
 func (rp *Respack) loadZipXML(f *zip.File) error {
 	r, err := f.Open()
 	if err != nil {
-		return err
+		return &RespackProblem{File: f.Name, Message: err.Error()}
 	}
 	defer r.Close()
-	return rp.unmarshal(r)
+	if err := rp.unmarshal(f.Name, r); err != nil {
+		return &RespackProblem{File: f.Name, Message: err.Error()}
+	}
+	return nil
 }
 
 func (rp *Respack) loadFSXML(root fs.FS, path string) error {
@@ -165,10 +276,13 @@ func (rp *Respack) loadFSXML(root fs.FS, path string) error {
 		return err
 	}
 	defer f.Close()
-	return rp.unmarshal(f)
+	if err := rp.unmarshal(path, f); err != nil {
+		return &RespackProblem{File: path, Message: err.Error()}
+	}
+	return nil
 }
 
-func (rp *Respack) unmarshal(r io.Reader) error {
+func (rp *Respack) unmarshal(filename string, r io.Reader) error {
 	content, err := io.ReadAll(r)
 	if err != nil {
 		return err
@@ -189,17 +303,33 @@ func (rp *Respack) unmarshal(r io.Reader) error {
 		mountFile = "songs.xml"
 		err = xml.Unmarshal(content, &rp.Songs)
 	case Hues:
-		mountFile = "hues.xml"
-		err = xml.Unmarshal(content, &rp.Hues)
+		var set HueSet
+		if err = xml.Unmarshal(content, &set); err == nil {
+			set.Name, set.file = hueSetName(filename), filepath.Base(filename)
+			rp.hueSets = append(rp.hueSets, set)
+		}
 	}
 	if err == nil && mountFile != "" {
-		rp.fileHandlers[mountFile] = func() (fs.File, error) {
-			return &byteFile{reader: bytes.NewReader(content)}, nil
-		}
+		rp.mountFile(mountFile, content)
 	}
 	return err
 }
 
+func (rp *Respack) mountFile(name string, content []byte) {
+	rp.fileHandlers[name] = func() (fs.File, error) {
+		return &byteFile{reader: bytes.NewReader(content)}, nil
+	}
+}
+
+func (rp *Respack) mountXML(name string, v any) error {
+	content, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	rp.mountFile(name, append([]byte(xml.Header), content...))
+	return nil
+}
+
 func (rp *Respack) resolveURI(resourceName string, extensions []string) (string, bool) {
 	if resourceName == "" {
 		return "", false
@@ -234,6 +364,94 @@ func (rp *Respack) resolveSongURI(songName string) (string, bool) {
 	return rp.resolveURI(songName, extensions)
 }
 
+// songForFile returns the song whose loop is the given file, and the respack
+// it comes from. Songs of virtual respacks keep the URI of their base respack.
+func (rp *Respack) songForFile(filename string) (respackID, song string, ok bool) {
+	for _, s := range rp.Songs.Song {
+		if id, file, ok := strings.Cut(s.URI, "/"); ok && file == filename {
+			return id, s.Name, true
+		}
+	}
+	return "", "", false
+}
+
+func hueSetName(filename string) string {
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)))
+	if rest, ok := strings.CutPrefix(name, "hues"); ok {
+		name = strings.TrimLeft(rest, "-_ ")
+	}
+	if name == "" {
+		return defaultHueSet
+	}
+	return name
+}
+
+// initHueSets makes the default hue set, or the first one if there is no
+// default, the hues of the respack. Sets with the same name are numbered.
+// Colors are normalized to #rrggbb. The hues with an invalid one keep their
+// place, so that hue indices still match the XML, but get fallbackHueColor
+// and are reported by Warnings.
+func (rp *Respack) initHueSets() error {
+	sets := rp.hueSets[:0]
+	for _, set := range rp.hueSets {
+		if len(set.Hue) == 0 {
+			continue
+		}
+		hues := make([]Hue, len(set.Hue))
+		for i, hue := range set.Hue {
+			hues[i] = Hue{Name: hue.Name, Color: fallbackHueColor}
+			if c, ok := parseHueColor(hue.Color); ok {
+				hues[i].Color = cssColor(c)
+				continue
+			}
+			rp.hueProblems = append(rp.hueProblems, &RespackProblem{
+				File:    set.file,
+				Message: fmt.Sprintf("invalid color %q for hue %s, using %s", strings.TrimSpace(hue.Color), hue.Name, fallbackHueColor),
+			})
+		}
+		set.Hue = hues
+		sets = append(sets, set)
+	}
+	rp.hueSets = sets
+	sort.SliceStable(rp.hueSets, func(i, j int) bool {
+		return rp.hueSets[i].Name == defaultHueSet && rp.hueSets[j].Name != defaultHueSet
+	})
+	names := make(map[string]int)
+	for i, set := range rp.hueSets {
+		if names[set.Name]++; names[set.Name] > 1 {
+			rp.hueSets[i].Name = fmt.Sprintf("%s-%d", set.Name, names[set.Name])
+		}
+	}
+	if len(rp.hueSets) == 0 {
+		return nil
+	}
+	for i := range rp.hueSets {
+		if err := rp.mountXML(rp.hueSets[i].file, &rp.hueSets[i]); err != nil {
+			return err
+		}
+	}
+	rp.Hues.Hue = rp.hueSets[0].Hue
+	return rp.mountXML("hues.xml", &rp.Hues)
+}
+
+// HueSets returns the hue sets of the respack. Virtual respacks have their
+// hues as the only set.
+func (rp *Respack) HueSets() []HueSet {
+	if len(rp.hueSets) == 0 && len(rp.Hues.Hue) > 0 {
+		return []HueSet{{Name: defaultHueSet, Hue: rp.Hues.Hue}}
+	}
+	return rp.hueSets
+}
+
+func (rp *Respack) HueSet(name string) (HueSet, bool) {
+	for _, set := range rp.HueSets() {
+		if set.Name == name {
+			return set, true
+		}
+	}
+	return HueSet{}, false
+}
+
 func (rp *Respack) resolveURIs() {
 	for i, image := range rp.Images.Image {
 		if imageURI, ok := rp.resolveImageURI(image.Name); ok {
@@ -250,6 +468,58 @@ func (rp *Respack) resolveURIs() {
 	}
 }
 
+// RespackProblem is an error or warning caused by a file of a respack.
+type RespackProblem struct {
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+func newRespackProblem(err error) *RespackProblem {
+	var problem *RespackProblem
+	if errors.As(err, &problem) {
+		return problem
+	}
+	return &RespackProblem{Message: err.Error()}
+}
+
+func (p *RespackProblem) Error() string {
+	if p.File == "" {
+		return p.Message
+	}
+	return p.File + ": " + p.Message
+}
+
+// Validate returns the problems that would prevent the player from using the
+// respack, such as songs or images without a matching resource file.
+func (rp *Respack) Validate() (problems []*RespackProblem) {
+	if rp.ImageCount() == 0 && rp.SongCount() == 0 {
+		problems = append(problems, &RespackProblem{Message: "respack has no songs or images"})
+	}
+	for _, image := range rp.Images.Image {
+		if image.URI == "" {
+			problems = append(problems, &RespackProblem{File: "images.xml", Message: "no image file for " + image.Name})
+		}
+	}
+	for _, song := range rp.Songs.Song {
+		if song.URI == "" {
+			problems = append(problems, &RespackProblem{File: "songs.xml", Message: "no audio file for " + song.Name})
+		}
+		if song.Buildup != "" && song.BuildupURI == "" {
+			problems = append(problems, &RespackProblem{File: "songs.xml", Message: "no audio file for buildup " + song.Buildup})
+		}
+		if song.Rhythm == "" {
+			problems = append(problems, &RespackProblem{File: "songs.xml", Message: "no rhythm for " + song.Name})
+		}
+	}
+	return problems
+}
+
+// Warnings returns the problems the player works around, such as hues with an
+// invalid color.
+func (rp *Respack) Warnings() []*RespackProblem {
+	return rp.hueProblems
+}
+
 func (rp *Respack) Name() string {
 	return rp.Info.Name
 }
@@ -271,13 +541,64 @@ func (rp *Respack) Open(name string) (fs.File, error) {
 	return nil, fmt.Errorf("not found")
 }
 
+// ModTime returns the modification time of the respack file, or the zero time
+// if the respack doesn't come from a file.
+func (rp *Respack) ModTime() time.Time {
+	return rp.modTime
+}
+
+// Close closes the ZIP archive of the respack once the files opened from it
+// are closed. No more files can be opened afterwards.
 func (rp *Respack) Close() error {
+	rp.closeMtx.Lock()
+	defer rp.closeMtx.Unlock()
+	if rp.closing {
+		return nil
+	}
+	rp.closing = true
+	if rp.readers > 0 {
+		return nil
+	}
+	return rp.closeArchive()
+}
+
+// closeArchive closes the ZIP archive. The caller must hold closeMtx.
+func (rp *Respack) closeArchive() error {
+	rp.closed = true
 	if rp.closer != nil {
+		openZipArchives.Add(-1)
 		return rp.closer.Close()
 	}
 	return nil
 }
 
+// openZipFile opens a file of the ZIP archive, which stays open until the
+// file is closed.
+func (rp *Respack) openZipFile(f *zip.File) (fs.File, error) {
+	rp.closeMtx.Lock()
+	defer rp.closeMtx.Unlock()
+	if rp.closed {
+		return nil, fs.ErrClosed
+	}
+	w, err := newFileWrapper(f)
+	if err != nil {
+		return nil, err
+	}
+	rp.readers++
+	w.release = rp.releaseReader
+	return w, nil
+}
+
+func (rp *Respack) releaseReader() {
+	rp.closeMtx.Lock()
+	defer rp.closeMtx.Unlock()
+	if rp.readers--; rp.readers == 0 && rp.closing && !rp.closed {
+		if err := rp.closeArchive(); err != nil {
+			log.Println(rp.ID, "-", err)
+		}
+	}
+}
+
 type fileInfo int
 
 func (fi fileInfo) Name() string       { return "*" }
@@ -305,8 +626,10 @@ func (bf *byteFile) Close() error {
 }
 
 type fileWrapper struct {
-	fi fs.FileInfo
-	rc io.ReadCloser
+	fi      fs.FileInfo
+	rc      io.ReadCloser
+	release func()
+	once    sync.Once
 }
 
 func newFileWrapper(f *zip.File) (*fileWrapper, error) {
@@ -314,6 +637,7 @@ func newFileWrapper(f *zip.File) (*fileWrapper, error) {
 	if err != nil {
 		return nil, err
 	}
+	openZipReaders.Add(1)
 	return &fileWrapper{fi: f.FileInfo(), rc: rc}, nil
 }
 
@@ -326,7 +650,15 @@ func (w *fileWrapper) Read(p []byte) (int, error) {
 }
 
 func (w *fileWrapper) Close() error {
-	return w.rc.Close()
+	err := fs.ErrClosed
+	w.once.Do(func() {
+		openZipReaders.Add(-1)
+		err = w.rc.Close()
+		if w.release != nil {
+			w.release()
+		}
+	})
+	return err
 }
 
 func respackFilenameToID(filename string) string {
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// Servers runs an HTTP server on each listen address of the config.
+type Servers struct {
+	servers []*http.Server
+	tls     bool
+}
+
+func NewServers(cfg *Config, handler http.Handler) (*Servers, error) {
+	s := &Servers{}
+	var tlsConfig *tls.Config
+	if cfg.TLS.Cert != "" || cfg.TLS.Key != "" {
+		certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		s.tls = true
+	}
+	for _, addr := range cfg.Listen {
+		s.servers = append(s.servers, &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+			IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+		})
+	}
+	return s, nil
+}
+
+// ListenAndServe starts the servers and returns the first error of a
+// listener that failed. It doesn't return after a shutdown.
+func (s *Servers) ListenAndServe() error {
+	errs := make(chan error, len(s.servers))
+	for _, server := range s.servers {
+		log.Println("Starting web server on address", server.Addr)
+		go func(server *http.Server) {
+			var err error
+			if s.tls {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}(server)
+	}
+	return <-errs
+}
+
+// Shutdown stops the servers and waits for the active connections to finish
+// until the context expires.
+func (s *Servers) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.servers))
+	for i, server := range s.servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+			if errs[i] = server.Shutdown(ctx); errs[i] != nil {
+				server.Close()
+			}
+		}(i, server)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// certReloader loads the TLS certificate again when its files change.
+type certReloader struct {
+	mtx       sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+	if modTime, err := cr.latestModTime(); err == nil && modTime.After(cr.modTime) {
+		if err := cr.reload(); err != nil {
+			log.Println("TLS certificate reload -", err)
+		} else {
+			log.Println("TLS certificate reloaded")
+		}
+	}
+	return cr.cert, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsDayFormat     = "2006-01-02"
+	statsRetentionDays = 90
+	statsFlushInterval = time.Minute
+	statsMaxLaunches   = 1000 // distinct respack combinations per day
+	// popularDays is the number of days the popular sort and the stats page
+	// count plays over.
+	popularDays = 30
+	popularSort = "popular"
+)
+
+// DayStats are the plays of a day. Mixes are keyed by their comma separated
+// respack IDs and songs by "respack/song".
+type DayStats struct {
+	Launches map[string]int `json:"launches,omitempty"`
+	Respacks map[string]int `json:"respacks,omitempty"`
+	Songs    map[string]int `json:"songs,omitempty"`
+}
+
+func newDayStats() *DayStats {
+	return &DayStats{
+		Launches: make(map[string]int),
+		Respacks: make(map[string]int),
+		Songs:    make(map[string]int),
+	}
+}
+
+// PlayStats counts player launches and song fetches per day. The counts are
+// kept in memory and written to the stats file periodically.
+type PlayStats struct {
+	mtx      sync.Mutex
+	filename string
+	days     map[string]*DayStats
+	dirty    bool
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func LoadPlayStats(filename string) (*PlayStats, error) {
+	stats := &PlayStats{
+		filename: filename,
+		days:     make(map[string]*DayStats),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := readJSONFile(filename, &stats.days); err != nil {
+		return nil, err
+	}
+	for _, day := range stats.days {
+		if day.Launches == nil {
+			day.Launches = make(map[string]int)
+		}
+		if day.Respacks == nil {
+			day.Respacks = make(map[string]int)
+		}
+		if day.Songs == nil {
+			day.Songs = make(map[string]int)
+		}
+	}
+	go stats.flushLoop()
+	return stats, nil
+}
+
+func (s *PlayStats) flushLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Println("stats -", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// today returns the stats of the current day. The caller must hold the lock.
+func (s *PlayStats) today() *DayStats {
+	key := time.Now().UTC().Format(statsDayFormat)
+	day, ok := s.days[key]
+	if !ok {
+		day = newDayStats()
+		s.days[key] = day
+	}
+	s.dirty = true
+	return day
+}
+
+// RecordLaunch counts a player launch with the given respacks. The same
+// respacks in any order and with repeats are one combination, and only the
+// first statsMaxLaunches combinations of a day are counted.
+func (s *PlayStats) RecordLaunch(respackIDs []string) {
+	unique := make(map[string]bool, len(respackIDs))
+	ids := make([]string, 0, len(respackIDs))
+	for _, respackID := range respackIDs {
+		if !unique[respackID] {
+			unique[respackID] = true
+			ids = append(ids, respackID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	sort.Strings(ids)
+	key := strings.Join(ids, ",")
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	day := s.today()
+	if _, ok := day.Launches[key]; ok || len(day.Launches) < statsMaxLaunches {
+		day.Launches[key]++
+	}
+	for _, respackID := range ids {
+		day.Respacks[respackID]++
+	}
+}
+
+// RecordSong counts a fetch of a song file.
+func (s *PlayStats) RecordSong(respackID, song string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.today().Songs[respackID+"/"+song]++
+}
+
+// Flush writes the stats file if anything changed and drops the days past
+// the retention period.
+func (s *PlayStats) Flush() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	oldest := time.Now().UTC().AddDate(0, 0, -statsRetentionDays).Format(statsDayFormat)
+	for key := range s.days {
+		if key < oldest {
+			delete(s.days, key)
+		}
+	}
+	if err := writeJSONFile(s.filename, s.days); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close stops the periodic writes and flushes the stats.
+func (s *PlayStats) Close() error {
+	close(s.done)
+	<-s.stopped
+	return s.Flush()
+}
+
+// PlayCount is the number of plays of a mix, respack or song.
+type PlayCount struct {
+	Key   string
+	Count int
+}
+
+// StatsSummary holds the most played items of the last days.
+type StatsSummary struct {
+	Days     int
+	Launches []PlayCount
+	Respacks []PlayCount
+	Songs    []PlayCount
+}
+
+// Summary returns the top plays of the last days.
+func (s *PlayStats) Summary(days, limit int) *StatsSummary {
+	total := s.sum(days)
+	return &StatsSummary{
+		Days:     days,
+		Launches: topPlayCounts(total.Launches, limit),
+		Respacks: topPlayCounts(total.Respacks, limit),
+		Songs:    topPlayCounts(total.Songs, limit),
+	}
+}
+
+func (s *PlayStats) sum(days int) *DayStats {
+	oldest := time.Now().UTC().AddDate(0, 0, 1-days).Format(statsDayFormat)
+	total := newDayStats()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, day := range s.days {
+		if key < oldest {
+			continue
+		}
+		for k, v := range day.Launches {
+			total.Launches[k] += v
+		}
+		for k, v := range day.Respacks {
+			total.Respacks[k] += v
+		}
+		for k, v := range day.Songs {
+			total.Songs[k] += v
+		}
+	}
+	return total
+}
+
+func topPlayCounts(counts map[string]int, limit int) []PlayCount {
+	results := make([]PlayCount, 0, len(counts))
+	for key, count := range counts {
+		results = append(results, PlayCount{Key: key, Count: count})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Count > results[j].Count ||
+			(results[i].Count == results[j].Count && results[i].Key < results[j].Key)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// SortRespacks sorts the respacks by their launches over the popular period,
+// then by size.
+func (s *PlayStats) SortRespacks(respacks []*Respack) {
+	plays := s.sum(popularDays).Respacks
+	sortRespacks(respacks)
+	sort.SliceStable(respacks, func(i, j int) bool {
+		return plays[respacks[i].ID] > plays[respacks[j].ID]
+	})
+}
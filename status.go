@@ -0,0 +1,51 @@
+package main
+
+// LibraryStatus is the public summary of the library, including the respacks
+// that failed to load and the problems found in the loaded ones.
+type LibraryStatus struct {
+	Respacks int              `json:"respacks"`
+	Songs    int              `json:"songs"`
+	Images   int              `json:"images"`
+	Failures []*RespackStatus `json:"failures"`
+	Warnings []*RespackStatus `json:"warnings"`
+}
+
+type RespackStatus struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+	Resource string `json:"resource,omitempty"`
+}
+
+func newRespackStatus(entry *LibraryEntry, problem *RespackProblem) *RespackStatus {
+	return &RespackStatus{
+		Filename: entry.Filename,
+		Error:    problem.Message,
+		Resource: problem.File,
+	}
+}
+
+func (lib *Library) Status() *LibraryStatus {
+	status := &LibraryStatus{
+		Failures: []*RespackStatus{},
+		Warnings: []*RespackStatus{},
+	}
+	lib.mtx.RLock()
+	status.Warnings = append(status.Warnings, lib.metaErrors...)
+	lib.mtx.RUnlock()
+	for _, entry := range lib.Entries() {
+		if entry.Disabled {
+			continue
+		}
+		if entry.Error != nil {
+			status.Failures = append(status.Failures, newRespackStatus(entry, entry.Error))
+			continue
+		}
+		status.Respacks++
+		status.Songs += entry.Respack.SongCount()
+		status.Images += entry.Respack.ImageCount()
+		for _, warning := range entry.Warnings {
+			status.Warnings = append(status.Warnings, newRespackStatus(entry, warning))
+		}
+	}
+	return status
+}
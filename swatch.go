@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+const (
+	swatchColumns  = 16
+	swatchCellSize = 16
+)
+
+// swatchSize returns the size of the swatch grid of n hues. Small palettes
+// take a single row.
+func swatchSize(n int) (columns, rows int) {
+	columns = swatchColumns
+	if n < columns {
+		columns = n
+	}
+	return columns, (n + swatchColumns - 1) / swatchColumns
+}
+
+// renderSwatchPNG draws the hues as a grid of squares, row by row. Hues
+// with an invalid color are left transparent.
+func renderSwatchPNG(hues []Hue) ([]byte, error) {
+	columns, rows := swatchSize(len(hues))
+	img := image.NewRGBA(image.Rect(0, 0, columns*swatchCellSize, rows*swatchCellSize))
+	for i, hue := range hues {
+		c, ok := parseHueColor(hue.Color)
+		if !ok {
+			continue
+		}
+		x, y := i%swatchColumns*swatchCellSize, i/swatchColumns*swatchCellSize
+		fillRect(img, image.Rect(x, y, x+swatchCellSize, y+swatchCellSize), c)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSwatchSVG is the same grid as renderSwatchPNG, with the names of
+// the hues as tooltips.
+func renderSwatchSVG(hues []Hue) []byte {
+	columns, rows := swatchSize(len(hues))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %[1]d %[2]d" shape-rendering="crispEdges">`,
+		columns*swatchCellSize, rows*swatchCellSize)
+	buf.WriteString("\n")
+	for i, hue := range hues {
+		c, ok := parseHueColor(hue.Color)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, `  <rect x="%d" y="%d" width="%d" height="%[3]d" fill="%s"><title>%s</title></rect>`+"\n",
+			i%swatchColumns*swatchCellSize, i/swatchColumns*swatchCellSize, swatchCellSize,
+			cssColor(c), html.EscapeString(hue.Name))
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+func cssColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// CSSColor returns the color of the hue in CSS syntax, or an empty string if
+// it's invalid.
+func (h Hue) CSSColor() string {
+	if c, ok := parseHueColor(h.Color); ok {
+		return cssColor(c)
+	}
+	return ""
+}
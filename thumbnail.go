@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	thumbnailMaxPixels   = 16 << 20
+	thumbnailJPEGQuality = 85
+)
+
+// thumbnailSizes are the allowed widths and heights of resized images, so
+// that clients can't fill the cache with arbitrary variants.
+var thumbnailSizes = []int{64, 128, 256, 512, 1024}
+
+// parseThumbnailSize returns the box requested by the w and h query
+// parameters. A missing side is 0, which doesn't limit the size.
+func parseThumbnailSize(query url.Values) (int, int, error) {
+	var size [2]int
+	for i, param := range []string{"w", "h"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || !allowedThumbnailSize(n) {
+			return 0, 0, fmt.Errorf("invalid %s: %s (allowed: %s)", param, value, strings.Trim(fmt.Sprint(thumbnailSizes), "[]"))
+		}
+		size[i] = n
+	}
+	return size[0], size[1], nil
+}
+
+func allowedThumbnailSize(n int) bool {
+	for _, size := range thumbnailSizes {
+		if n == size {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnailType returns the content type of the resized variants of an
+// image. GIFs become PNGs to keep their transparency without quantizing.
+func thumbnailType(filename string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png", ".gif":
+		return "image/png", true
+	case ".jpg", ".jpeg":
+		return "image/jpeg", true
+	default:
+		return "", false
+	}
+}
+
+func isGIF(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".gif"
+}
+
+// renderThumbnail scales the image down to fit in the box. It returns false
+// if the image already fits, as images are never scaled up.
+func renderThumbnail(data []byte, filename string, maxWidth, maxHeight int) ([]byte, bool, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return nil, false, fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	if maxWidth == 0 {
+		maxWidth = config.Width
+	}
+	if maxHeight == 0 {
+		maxHeight = config.Height
+	}
+	width, height := fitSize(config.Width, config.Height, maxWidth, maxHeight, false)
+	if width == config.Width && height == config.Height {
+		return nil, false, nil
+	}
+	acquireImageRender()
+	defer releaseImageRender()
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	img := resizeImage(src, width, height)
+
+	var buf bytes.Buffer
+	if contentType, _ := thumbnailType(filename); contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// ThumbnailCache keeps resized images on disk, in a directory per respack
+// that only holds the ones of its current file. When the cache grows over
+// its size limit, the oldest ones are removed. It's disabled if it has no
+// directory.
+type ThumbnailCache struct {
+	dir     string
+	maxSize int64
+
+	mtx      sync.Mutex
+	size     int64 // as of the last sweep, plus what was added since
+	sweeping bool
+}
+
+func NewThumbnailCache(dir string, maxSize int64) (*ThumbnailCache, error) {
+	c := &ThumbnailCache{dir: dir, maxSize: maxSize}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.size += f.size
+	}
+	return c, nil
+}
+
+// respackDir returns the directory of the thumbnails of a respack, and the
+// one of its current file in it. Thumbnails of several respacks, like the
+// previews of saved mixes, have none.
+func (c *ThumbnailCache) respackDir(respack *Respack) (string, string) {
+	if respack == nil {
+		return c.dir, c.dir
+	}
+	sum := sha256.Sum256([]byte(respack.ID))
+	dir := filepath.Join(c.dir, hex.EncodeToString(sum[:16]))
+	return dir, filepath.Join(dir, strconv.FormatInt(respack.ModTime().Unix(), 10))
+}
+
+func (c *ThumbnailCache) path(respack *Respack, key string) string {
+	_, dir := c.respackDir(respack)
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *ThumbnailCache) Get(respack *Respack, key string) ([]byte, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(respack, key))
+	return data, err == nil
+}
+
+// Add stores a thumbnail. It's written to a temporary file first so that
+// concurrent readers never see a partial one. The first thumbnail of a new
+// respack file replaces those of the previous one.
+func (c *ThumbnailCache) Add(respack *Respack, key string, data []byte) error {
+	if c.dir == "" {
+		return nil
+	}
+	respackDir, fileDir := c.respackDir(respack)
+	if _, err := os.Stat(fileDir); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(fileDir, 0755); err != nil {
+			return err
+		}
+		c.removeStale(respackDir, fileDir)
+	}
+	f, err := os.CreateTemp(fileDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(respack, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mtx.Lock()
+	c.size += int64(len(data))
+	sweep := c.maxSize > 0 && c.size > c.maxSize && !c.sweeping
+	c.sweeping = c.sweeping || sweep
+	c.mtx.Unlock()
+	if sweep {
+		c.sweep()
+	}
+	return nil
+}
+
+// removeStale removes the thumbnails of the older files of a respack. Newer
+// ones are left alone, as requests may still be served from the file that
+// was replaced.
+func (c *ThumbnailCache) removeStale(respackDir, fileDir string) {
+	if respackDir == fileDir {
+		return
+	}
+	current, _ := strconv.ParseInt(filepath.Base(fileDir), 10, 64)
+	entries, err := os.ReadDir(respackDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if version, err := strconv.ParseInt(entry.Name(), 10, 64); err != nil || version >= current {
+			continue
+		}
+		dir := filepath.Join(respackDir, entry.Name())
+		size := int64(0)
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				if fi, err := d.Info(); err == nil {
+					size += fi.Size()
+				}
+			}
+			return nil
+		})
+		if err := os.RemoveAll(dir); err != nil {
+			log.Println("thumbnails -", err)
+			continue
+		}
+		c.mtx.Lock()
+		c.size -= size
+		c.mtx.Unlock()
+	}
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the thumbnails in the cache.
+func (c *ThumbnailCache) files() ([]cachedFile, error) {
+	var files []cachedFile
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// sweep removes the oldest thumbnails until the cache is down to 90% of its
+// size limit, so that it doesn't have to sweep again for the next ones.
+func (c *ThumbnailCache) sweep() {
+	defer func() {
+		c.mtx.Lock()
+		c.sweeping = false
+		c.mtx.Unlock()
+	}()
+	files, err := c.files()
+	if err != nil {
+		log.Println("thumbnails -", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	size := int64(0)
+	for _, f := range files {
+		size += f.size
+	}
+	for _, f := range files {
+		if size <= c.maxSize/10*9 {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("thumbnails -", err)
+			continue
+		}
+		size -= f.size
+	}
+	c.mtx.Lock()
+	c.size = size
+	c.mtx.Unlock()
+}
+
+// thumbnailCacheKey identifies a resized variant of a respack file.
+func thumbnailCacheKey(filename string, width, height int) string {
+	return fmt.Sprintf("%s?w=%d&h=%d", filename, width, height)
+}
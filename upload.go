@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	stagingDir    = ".staging"
+	quarantineDir = ".quarantine"
+)
+
+type UploadLimits struct {
+	MaxSize         int64 `json:"maxSize"`
+	MaxUnpackedSize int64 `json:"maxUnpackedSize"`
+	MaxEntries      int   `json:"maxEntries"`
+}
+
+func (limits UploadLimits) MaxSizeMB() int64 {
+	return limits.MaxSize >> 20
+}
+
+// UploadReport describes why an uploaded respack was rejected. It is kept in
+// the quarantine directory next to the rejected file.
+type UploadReport struct {
+	Filename string    `json:"filename"`
+	Time     time.Time `json:"time"`
+	Problems []string  `json:"problems"`
+}
+
+type UploadError struct {
+	Report *UploadReport
+}
+
+func (err *UploadError) Error() string {
+	return err.Report.Filename + ": " + strings.Join(err.Report.Problems, "; ")
+}
+
+// Uploader stages uploaded respacks, validates them and moves the valid ones
+// into the library. Rejected files are moved to quarantine.
+type Uploader struct {
+	respackDir string
+	limits     UploadLimits
+	library    *Library
+}
+
+func NewUploader(respackDir string, limits UploadLimits, library *Library) *Uploader {
+	return &Uploader{
+		respackDir: respackDir,
+		limits:     limits,
+		library:    library,
+	}
+}
+
+func (u *Uploader) Limits() UploadLimits {
+	return u.limits
+}
+
+func (u *Uploader) Upload(filename string, r io.Reader) (*Respack, error) {
+	name, err := uploadFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := u.library.Get(respackFilenameToID(name)); ok {
+		return nil, fmt.Errorf("respack already exists: %s", respackFilenameToID(name))
+	}
+
+	stagingRoot := filepath.Join(u.respackDir, stagingDir)
+	if err := os.MkdirAll(stagingRoot, 0755); err != nil {
+		return nil, err
+	}
+	stage, err := os.MkdirTemp(stagingRoot, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stage)
+
+	stagedFile := filepath.Join(stage, name)
+	size, err := writeLimitedFile(stagedFile, r, u.limits.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if size > u.limits.MaxSize {
+		problem := fmt.Sprintf("file is larger than %d bytes", u.limits.MaxSize)
+		return nil, u.reject(name, "", []string{problem})
+	}
+
+	if problems := u.validate(stagedFile); len(problems) > 0 {
+		return nil, u.reject(name, stagedFile, problems)
+	}
+
+	respack, err := u.library.AddFile(stagedFile, name)
+	if errors.Is(err, errRespackExists) {
+		return nil, u.reject(name, stagedFile, []string{err.Error()})
+	} else if err != nil {
+		return nil, err
+	}
+	return respack, nil
+}
+
+func (u *Uploader) validate(filename string) (problems []string) {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var unpackedSize uint64
+	for _, f := range r.File {
+		unpackedSize += f.UncompressedSize64
+	}
+	r.Close()
+	if len(r.File) > u.limits.MaxEntries {
+		problems = append(problems, fmt.Sprintf("zip has %d entries, the limit is %d", len(r.File), u.limits.MaxEntries))
+	}
+	if unpackedSize > uint64(u.limits.MaxUnpackedSize) {
+		problems = append(problems, fmt.Sprintf("zip unpacks to %d bytes, the limit is %d", unpackedSize, u.limits.MaxUnpackedSize))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	respack, err := LoadRespackZIP(filename)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer respack.Close()
+	for _, problem := range respack.Validate() {
+		problems = append(problems, problem.Error())
+	}
+	return problems
+}
+
+func (u *Uploader) reject(name, stagedFile string, problems []string) error {
+	report := &UploadReport{
+		Filename: name,
+		Time:     time.Now(),
+		Problems: problems,
+	}
+	dir := filepath.Join(u.respackDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, report.Time.Format("20060102-150405.000")+"-"+name)
+	if stagedFile != "" {
+		if err := os.Rename(stagedFile, base); err != nil {
+			return err
+		}
+	}
+	if err := writeJSONFile(base+".json", report); err != nil {
+		return err
+	}
+	return &UploadError{Report: report}
+}
+
+// Rejected returns the reports of the most recent rejected uploads.
+func (u *Uploader) Rejected(limit int) ([]*UploadReport, error) {
+	dir := filepath.Join(u.respackDir, quarantineDir)
+	reportFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(reportFiles)))
+	if len(reportFiles) > limit {
+		reportFiles = reportFiles[:limit]
+	}
+	reports := make([]*UploadReport, 0, len(reportFiles))
+	for _, reportFile := range reportFiles {
+		report := &UploadReport{}
+		if err := readJSONFile(reportFile, report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func uploadFilename(filename string) (string, error) {
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	ext := filepath.Ext(name)
+	if !strings.EqualFold(ext, ".zip") || len(name) == len(ext) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid respack file name: %q", filename)
+	}
+	return strings.TrimSuffix(name, ext) + ".zip", nil
+}
+
+// writeLimitedFile writes at most limit+1 bytes, so the caller can tell when
+// the limit is exceeded without reading the whole input.
+func writeLimitedFile(filename string, r io.Reader, limit int64) (int64, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return limit + 1, nil
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Virtual respacks are generated on the fly from the loaded ones. Their ID
+// encodes everything needed to rebuild them, so they need no server state.
+const (
+	virtualRespackPrefix    = "~"
+	virtualRespackCacheSize = 256
+)
+
+type respackLookup func(id string) (*Respack, bool)
+
+// disabledVirtualKinds are the kinds of virtual respacks turned off in the
+// config. It's only changed at startup.
+var disabledVirtualKinds = make(map[string]bool)
+
+func disableVirtualRespacks(kinds ...string) {
+	for _, kind := range kinds {
+		disabledVirtualKinds[kind] = true
+	}
+}
+
+func isVirtualRespackID(id string) bool {
+	return strings.HasPrefix(id, virtualRespackPrefix)
+}
+
+func virtualRespackID(kind string, params url.Values) string {
+	return virtualRespackPrefix + kind + "-" + base64.RawURLEncoding.EncodeToString([]byte(params.Encode()))
+}
+
+func parseVirtualRespackID(id string) (kind string, params url.Values, err error) {
+	kind, payload, ok := strings.Cut(strings.TrimPrefix(id, virtualRespackPrefix), "-")
+	if !ok || !isVirtualRespackID(id) {
+		return "", nil, fmt.Errorf("not a virtual respack: %s", id)
+	}
+	query, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	params, err = url.ParseQuery(string(query))
+	return kind, params, err
+}
+
+func resolveVirtualRespack(id string, lookup respackLookup) (*Respack, error) {
+	kind, params, err := parseVirtualRespackID(id)
+	if err != nil {
+		return nil, err
+	}
+	if disabledVirtualKinds[kind] {
+		return nil, fmt.Errorf("virtual respack type is disabled: %s", kind)
+	}
+	switch kind {
+	case "mix":
+		mix, err := parseMix(params)
+		if err != nil {
+			return nil, err
+		}
+		return mix.Respack(lookup)
+	case "hues":
+		return huesRespack(params, lookup)
+	case "lite":
+		return liteRespack(params, lookup)
+	case "palette":
+		return paletteRespack(params, lookup)
+	case "custom":
+		return customHuesRespack(params)
+	default:
+		return nil, fmt.Errorf("unknown virtual respack type: %s", kind)
+	}
+}
+
+// findRespack returns a loaded or a virtual respack.
+func findRespack(id string, lookup respackLookup) (*Respack, error) {
+	if isVirtualRespackID(id) {
+		return resolveVirtualRespack(id, lookup)
+	}
+	if respack, ok := lookup(id); ok {
+		return respack, nil
+	}
+	return nil, fmt.Errorf("unknown respack: %s", id)
+}
+
+func respackResourceSource(respackID, name string) string {
+	return "respacks/" + respackID + "/" + url.PathEscape(name)
+}
+
+// respackResourceID returns the respack of a resource source, if the source
+// is served by this app.
+func respackResourceID(source string) (string, bool) {
+	rest, ok := strings.CutPrefix(source, "respacks/")
+	if !ok {
+		return "", false
+	}
+	respackID, _, ok := strings.Cut(rest, "/")
+	return respackID, ok
+}
+
+// previewRespackID returns the respack whose preview image stands for the
+// respack: itself, or for virtual respacks the first library respack their
+// images or songs come from. Virtual respacks with neither have none.
+func previewRespackID(rp *Respack) string {
+	if !isVirtualRespackID(rp.ID) {
+		return rp.ID
+	}
+	var uris []string
+	for _, image := range rp.Images.Image {
+		uris = append(uris, image.URI)
+	}
+	for _, song := range rp.Songs.Song {
+		uris = append(uris, song.URI)
+	}
+	for _, uri := range uris {
+		respackID, _, ok := strings.Cut(uri, "/")
+		if kind, params, err := parseVirtualRespackID(respackID); err == nil && kind == "lite" {
+			respackID = params.Get("respack")
+		}
+		if ok && respackID != "" && !isVirtualRespackID(respackID) {
+			return respackID
+		}
+	}
+	return ""
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -26,59 +34,257 @@ var (
 		"divide": func(a, b int) int {
 			return a / b
 		},
+		"searchTag":        searchTag,
+		"previewRespackID": previewRespackID,
 	}
 	huesT        = must(loadTemplate("", "assets/index.html"))
 	respacksT    = must(loadTemplate("Respack selector", "assets/layout.html", "assets/respacks.html"))
+	statusT      = must(loadTemplate("Status", "assets/layout.html", "assets/status.html"))
+	statsT       = must(loadTemplate("Popular", "assets/layout.html", "assets/stats.html"))
+	adminT       = must(loadTemplate("Admin", "assets/layout.html", "assets/admin.html"))
+	uploadT      = must(loadTemplate("Upload respack", "assets/layout.html", "assets/upload.html"))
 	respackInfoT = must(loadTemplate("Respack info", "assets/layout.html", "assets/respackinfo.html"))
 	builtinR     = must(LoadRespackFS(assets, "assets/builtin"))
 	builtinImgR  = must(LoadRespackFS(assets, "assets/builtin_image"))
 )
 
-func GetHandlers(respacks []*Respack) http.Handler {
-	respackMap := make(map[string]*Respack)
-	for _, respack := range respacks {
-		respackMap[respack.ID] = respack
+func GetHandlers(cfg *Config, library *Library, links *LinkStore, stats *PlayStats, palettes *PaletteLibrary, uploader *Uploader) http.Handler {
+	auth := cfg.BasicAuth()
+	builtins := map[string]*Respack{
+		builtinR.ID:    builtinR,
+		builtinImgR.ID: builtinImgR,
+	}
+	lookupRespack := func(id string) (*Respack, bool) {
+		if respack, ok := builtins[id]; ok {
+			return respack, true
+		}
+		return library.Get(id)
+	}
+	// Virtual respacks are cached per library generation, as they hold the
+	// respacks they were built from.
+	virtualRespacks := newMemoryCache[*Respack](virtualRespackCacheSize)
+	getRespack := func(id string) (*Respack, bool) {
+		if isVirtualRespackID(id) {
+			key := strconv.FormatUint(library.Generation(), 10) + ":" + id
+			if respack, ok := virtualRespacks.Get(key); ok {
+				return respack, true
+			}
+			respack, err := resolveVirtualRespack(id, lookupRespack)
+			if err != nil {
+				return nil, false
+			}
+			virtualRespacks.Add(key, respack)
+			return respack, true
+		}
+		return lookupRespack(id)
+	}
+
+	metrics := NewMetrics()
+	thumbnails := must(NewThumbnailCache(cfg.Cache.Thumbnails, cfg.Cache.MaxThumbnailsSize))
+	limiter := must(NewRateLimiter(cfg.Limits.Respacks))
+	sorts := make(map[string]func([]*Respack), len(respackSorts)+1)
+	for name, sort := range respackSorts {
+		sorts[name] = sort
+	}
+	if stats != nil {
+		sorts[popularSort] = stats.SortRespacks
 	}
-	respackMap[builtinR.ID] = builtinR
-	respackMap[builtinImgR.ID] = builtinImgR
 
 	assets, _ := fs.Sub(assets, "assets")
-	fs := http.FileServer(http.FS(assets))
+	fs := http.StripPrefix(strings.TrimSuffix(cfg.BasePath, "/"), http.FileServer(http.FS(assets)))
 	r := chi.NewRouter()
+	r.Use(frameOptions(cfg.Embed.FrameOptions))
+
+	cached := cacheControl(time.Duration(cfg.Cache.MaxAge))
+	r.With(cached).Get("/css/*", fs.ServeHTTP)
+	r.With(cached).Get("/js/*", fs.ServeHTTP)
+	r.With(cached).Get("/fonts/*", fs.ServeHTTP)
+	r.With(cached).Get("/favicon.ico", fs.ServeHTTP)
 
-	r.Get("/css/*", fs.ServeHTTP)
-	r.Get("/js/*", fs.ServeHTTP)
-	r.Get("/fonts/*", fs.ServeHTTP)
-	r.Get("/favicon.ico", fs.ServeHTTP)
+	renderRespackList := func(w http.ResponseWriter, r *http.Request, path, collection string, respacks []*Respack) {
+		view, err := newRespacksView(path, collection, r.URL.Query(), respacks, sorts, cfg.Sort)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		view.Links = links != nil
+		respacksT(w, r, view)
+	}
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		search := r.URL.Query().Get("search")
-		respacks := filterRespacks(respacks, search)
-		respacksT(w, r, &respacksView{
-			Search:   search,
-			Respacks: respacks,
-		})
+		renderRespackList(w, r, "", "", library.Respacks())
+	})
+
+	r.Get("/collection/{collection}/", func(w http.ResponseWriter, r *http.Request) {
+		collection := chi.URLParam(r, "collection")
+		respacks := filterCollection(library.Respacks(), collection)
+		if len(respacks) == 0 {
+			http.Error(w, "Unknown collection: "+collection, http.StatusNotFound)
+			return
+		}
+		path := "collection/" + url.PathEscape(collection) + "/"
+		renderRespackList(w, r, path, collection, respacks)
 	})
 
-	renderRespacks := func(w http.ResponseWriter, r *http.Request, respacks ...string) {
-		images := 0
-		for _, respackID := range respacks {
-			if respack, ok := respackMap[respackID]; ok {
-				images += respack.ImageCount()
+	// findPlayerLink resolves short links too.
+	findPlayerLink := func(rawURL, basePath string) (*SavedMix, error) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if code, ok := strings.CutPrefix(strings.TrimPrefix(u.Path, basePath), "m/"); ok && links != nil {
+			if link, ok := links.Get(code); ok {
+				return link, nil
+			}
+			return nil, fmt.Errorf("link %w: %s", errNotFound, code)
+		}
+		return parsePlayerURL(rawURL, basePath)
+	}
+
+	playerConfig := func(query url.Values, respackIDs ...string) (*huesConfig, error) {
+		respacks := make([]*Respack, 0, len(respackIDs))
+		for _, respackID := range respackIDs {
+			if respack, ok := getRespack(respackID); ok {
+				respacks = append(respacks, respack)
 			} else {
-				http.Error(w, "Unknown respack: "+respackID, http.StatusNotFound)
+				return nil, fmt.Errorf("respack %w: %s", errNotFound, respackID)
+			}
+		}
+		return newHuesConfig(query, respacks, lookupRespack, palettes)
+	}
+
+	serveThumbnail := func(w http.ResponseWriter, r *http.Request, respack *Respack, filename string, f io.Reader, width, height int) {
+		contentType, ok := thumbnailType(filename)
+		if !ok {
+			http.Error(w, "not a resizable image: "+filename, http.StatusBadRequest)
+			return
+		}
+		key := thumbnailCacheKey(filename, width, height)
+		thumbnail, ok := thumbnails.Get(respack, key)
+		metrics.CacheResult("thumbnail", ok)
+		if !ok {
+			data, err := io.ReadAll(f)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			thumbnail, ok, err = renderThumbnail(data, filename, width, height)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if !ok {
+				// the image is already small enough
+				thumbnail, contentType = data, mime.TypeByExtension(filepath.Ext(filename))
+			} else if err := thumbnails.Add(respack, key, thumbnail); err != nil {
+				logRequestError(r, err)
+			}
 		}
-		if images == 0 {
-			respacks = append(respacks, "builtin_image")
+		w.Header().Set("Content-Type", contentType)
+		w.Write(thumbnail)
+		metrics.AddRespackBytes(respack.ID, int64(len(thumbnail)))
+	}
+
+	servePreview := func(w http.ResponseWriter, r *http.Request, key, title string, respacks []*Respack) {
+		// previews of several respacks are only replaced when the cache is
+		// swept, so their key changes with any of the respacks
+		cacheKey := "preview:" + key + ":" + respacksCacheKey(respacks)
+		var respack *Respack
+		if len(respacks) == 1 {
+			respack = respacks[0]
 		}
-		song, _ := strconv.Atoi(r.URL.Query().Get("song"))
-		huesT(w, r, &huesConfig{
-			Respacks:    respacks,
-			DefaultSong: song,
-			AutoPlay:    true,
-		})
+		preview, ok := thumbnails.Get(respack, cacheKey)
+		metrics.CacheResult("preview", ok)
+		if !ok {
+			var err error
+			preview, err = renderPreview(key, title, respacks, lookupRespack)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := thumbnails.Add(respack, cacheKey, preview); err != nil {
+				logRequestError(r, err)
+			}
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(preview)
+	}
+
+	servePlaylist := func(w http.ResponseWriter, r *http.Request, respack *Respack, format string) {
+		tracks := playlistTracks(respack)
+		if len(tracks) == 0 {
+			http.Error(w, "respack has no songs", http.StatusNotFound)
+			return
+		}
+		baseURL := absoluteURL(r, "respacks/")
+		var content []byte
+		if format == "xspf" {
+			var err error
+			content, err = renderXSPF(respack.Name(), respack.Info.Author, tracks, baseURL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xspf+xml")
+		} else {
+			content = renderM3U(respack.Name(), tracks, baseURL)
+			w.Header().Set("Content-Type", "audio/x-mpegurl")
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": respack.Name() + "." + format}))
+		w.Write(content)
+	}
+
+	renderRespacks := func(w http.ResponseWriter, r *http.Request, respackIDs ...string) {
+		query := r.URL.Query()
+		sessionLiteOption(w, r, query)
+		config, err := playerConfig(query, respackIDs...)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if lite := r.URL.Query().Get("lite"); lite != "" {
+			rememberLiteOption(w, r, lite)
+		}
+		if stats != nil {
+			// virtual respacks are left out, as there is no end to them
+			var launched []string
+			for _, respackID := range respackIDs {
+				if _, ok := lookupRespack(respackID); ok {
+					launched = append(launched, respackID)
+				}
+			}
+			stats.RecordLaunch(launched)
+		}
+		view := &playerView{Config: config}
+		// Saved mixes have their own preview, other players use the one of
+		// their first library respack.
+		if code := chi.URLParam(r, "code"); code != "" {
+			view.Preview = "preview/m/" + url.PathEscape(code) + "/image.png"
+		} else {
+			for _, respackID := range respackIDs {
+				if _, ok := lookupRespack(respackID); ok {
+					view.Preview = "preview/" + url.PathEscape(respackID) + "/image.png"
+					break
+				}
+			}
+		}
+		var names []string
+		var songs, images int
+		for _, respackID := range respackIDs {
+			respack, _ := getRespack(respackID)
+			names = append(names, respack.Name())
+			songs += respack.SongCount()
+			images += respack.ImageCount()
+		}
+		view.Title = strings.Join(names, " + ")
+		view.Description = fmt.Sprintf("0x40 Hues with %d songs and %d images", songs, images)
+		if cfg.Features.Embed {
+			view.OEmbed = "oembed?url=" + url.QueryEscape(requestURL(r))
+		}
+		huesT(w, r, view)
 	}
 
 	r.Get("/{respacks}/", func(w http.ResponseWriter, r *http.Request) {
@@ -86,23 +292,150 @@ func GetHandlers(respacks []*Respack) http.Handler {
 		renderRespacks(w, r, respacks...)
 	})
 
+	embed := r.With(enabled(cfg.Features.Embed))
+	embed.With(frameAncestors(cfg.Embed.FrameAncestors)).Get("/embed/{respacks}/", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		for _, option := range []string{"muted", "hideUI"} {
+			if !query.Has(option) {
+				query.Set(option, "true")
+			}
+		}
+		r.URL.RawQuery = query.Encode()
+		respacks := strings.Split(chi.URLParam(r, "respacks"), ",")
+		renderRespacks(w, r, respacks...)
+	})
+
+	embed.Get("/oembed", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if format := query.Get("format"); format != "" && format != "json" {
+			http.Error(w, "Unsupported format: "+format, http.StatusNotImplemented)
+			return
+		}
+		link, err := findPlayerLink(query.Get("url"), requestBase(r))
+		if errors.Is(err, errNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respackIDs, err := link.RespackIDs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var names []string
+		for _, respackID := range respackIDs {
+			respack, ok := getRespack(respackID)
+			if !ok {
+				http.Error(w, "Unknown respack: "+respackID, http.StatusNotFound)
+				return
+			}
+			names = append(names, respack.Name())
+		}
+		embedPath, err := link.embedPath()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		oembed, err := newOEmbed(absoluteURL(r, embedPath), absoluteURL(r, ""), strings.Join(names, " + "), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oembed)
+	})
+
 	r.Get("/custom/", func(w http.ResponseWriter, r *http.Request) {
 		respacks := strings.Split(r.URL.Query().Get("packs"), ",")
 		renderRespacks(w, r, respacks...)
 	})
 
+	r.With(enabled(cfg.Features.Mixes)).Get("/mix/", func(w http.ResponseWriter, r *http.Request) {
+		mix, err := parseMix(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := mix.Respack(lookupRespack); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		renderRespacks(w, r, mix.ID())
+	})
+
+	r.With(enabled(cfg.Features.Mixes), limiter.Middleware).Get("/mix/playlist.{format:m3u|xspf}", func(w http.ResponseWriter, r *http.Request) {
+		mix, err := parseMix(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respack, err := mix.Respack(lookupRespack)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		servePlaylist(w, r, respack, chi.URLParam(r, "format"))
+	})
+
+	r.With(enabled(links != nil)).Get("/m/{code}", func(w http.ResponseWriter, r *http.Request) {
+		link, ok := links.Get(chi.URLParam(r, "code"))
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		respackIDs, err := link.RespackIDs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.URL.RawQuery = link.Query.Encode()
+		renderRespacks(w, r, respackIDs...)
+	})
+
+	r.With(enabled(links != nil), limiter.Limit("links", cfg.Limits.LinkCreation)).Post("/m", func(w http.ResponseWriter, r *http.Request) {
+		rawURL := r.FormValue("url")
+		if len(rawURL) > maxLinkURLLength {
+			http.Error(w, "URL too long", http.StatusBadRequest)
+			return
+		}
+		link, err := parsePlayerURL(rawURL, requestBase(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respackIDs, err := link.RespackIDs()
+		if err == nil {
+			_, err = playerConfig(link.Query, respackIDs...)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		code, err := links.Add(link)
+		if errors.Is(err, errLinkStoreFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redirect(w, r, "m/"+code)
+	})
+
 	r.Post("/custom", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		respacks := make([]string, 0, len(r.Form))
 		for respack := range r.Form {
 			respacks = append(respacks, respack)
 		}
-		http.Redirect(w, r, "/"+strings.Join(respacks, ",")+"/", http.StatusSeeOther)
+		redirect(w, r, strings.Join(respacks, ",")+"/")
 	})
 
-	r.Get("/respacks/{respack}/*", func(w http.ResponseWriter, r *http.Request) {
+	r.With(limiter.Middleware, cached).Get("/respacks/{respack}/*", func(w http.ResponseWriter, r *http.Request) {
 		respackID := chi.URLParam(r, "respack")
-		if respack, ok := respackMap[respackID]; ok {
+		if respack, ok := getRespack(respackID); ok {
 			filename, err := url.QueryUnescape(chi.URLParam(r, "*"))
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -114,32 +447,274 @@ func GetHandlers(respacks []*Respack) http.Handler {
 				return
 			}
 			defer f.Close()
+			if query := r.URL.Query(); query.Has("w") || query.Has("h") {
+				width, height, err := parseThumbnailSize(query)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				serveThumbnail(w, r, respack, filename, f, width, height)
+				return
+			}
+			// GIFs are served as is, as their thumbnails only have the first frame
+			if _, ok := thumbnailType(filename); ok && respack.imageHeight > 0 && !isGIF(filename) {
+				serveThumbnail(w, r, respack, filename, f, 0, respack.imageHeight)
+				return
+			}
 			w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(filename)))
-			io.Copy(w, f)
+			n, err := io.Copy(w, f)
+			metrics.AddRespackBytes(respackID, n)
+			if err != nil {
+				logRequestError(r, err)
+				return
+			}
+			if baseID, song, ok := respack.songForFile(filename); ok && stats != nil {
+				stats.RecordSong(baseID, song)
+			}
 		} else {
 			http.Error(w, "Not Found", http.StatusNotFound)
 		}
 	})
 
+	// Previews are only rendered for library respacks and saved mixes, so
+	// there is a bounded number of them to cache.
+	r.With(limiter.Middleware, cached).Get("/preview/{respack}/image.png", func(w http.ResponseWriter, r *http.Request) {
+		respackID := chi.URLParam(r, "respack")
+		respack, ok := lookupRespack(respackID)
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		servePreview(w, r, respackID, respack.Name(), []*Respack{respack})
+	})
+
+	r.With(enabled(links != nil), limiter.Middleware, cached).Get("/preview/m/{code}/image.png", func(w http.ResponseWriter, r *http.Request) {
+		code := chi.URLParam(r, "code")
+		link, ok := links.Get(code)
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		respackIDs, err := link.RespackIDs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respacks := make([]*Respack, 0, len(respackIDs))
+		var names []string
+		for _, respackID := range respackIDs {
+			respack, ok := getRespack(respackID)
+			if !ok {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			respacks = append(respacks, respack)
+			names = append(names, respack.Name())
+		}
+		servePreview(w, r, "m/"+code, strings.Join(names, " + "), respacks)
+	})
+
 	r.Get("/respack-info/{respack}/", func(w http.ResponseWriter, r *http.Request) {
 		respackID := chi.URLParam(r, "respack")
-		if respack, ok := respackMap[respackID]; ok {
+		if respack, ok := getRespack(respackID); ok {
 			respackInfoT(w, r, respack)
 		} else {
 			http.Error(w, "Not Found", http.StatusNotFound)
 		}
 	})
 
-	return r
+	r.With(cached).Get("/respack-info/{respack}/hues.{format:png|svg}", func(w http.ResponseWriter, r *http.Request) {
+		respack, ok := getRespack(chi.URLParam(r, "respack"))
+		if !ok || len(respack.Hues.Hue) == 0 {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		hues := respack.Hues.Hue
+		if name := r.URL.Query().Get("set"); name != "" {
+			set, ok := respack.HueSet(name)
+			if !ok {
+				http.Error(w, "Unknown hue set: "+name, http.StatusNotFound)
+				return
+			}
+			hues = set.Hue
+		}
+		if chi.URLParam(r, "format") == "svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(renderSwatchSVG(hues))
+			return
+		}
+		swatch, err := renderSwatchPNG(hues)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(swatch)
+	})
+
+	r.With(limiter.Middleware, cached).Get("/respack-info/{respack}/playlist.{format:m3u|xspf}", func(w http.ResponseWriter, r *http.Request) {
+		respack, ok := getRespack(chi.URLParam(r, "respack"))
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		servePlaylist(w, r, respack, chi.URLParam(r, "format"))
+	})
+
+	r.With(limiter.Middleware, cached).Get("/respack-info/{respack}/palette.xml", func(w http.ResponseWriter, r *http.Request) {
+		colors := r.URL.Query().Get("colors")
+		if colors == "" {
+			colors = strconv.Itoa(defaultPaletteColors)
+		}
+		params := url.Values{"respack": {chi.URLParam(r, "respack")}, "colors": {colors}}
+		respack, err := paletteRespack(params, lookupRespack)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := respack.Open("hues.xml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/xml")
+		io.Copy(w, f)
+	})
+
+	if cfg.Features.Status {
+		r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+			statusT(w, r, library.Status())
+		})
+
+		r.Get("/status.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(library.Status())
+		})
+	}
+
+	if stats != nil {
+		r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+			statsT(w, r, newStatsView(stats.Summary(popularDays, 20), getRespack))
+		})
+	}
+
+	r.With(enabled(cfg.Features.Metrics)).Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w, library)
+	})
+
+	if auth != nil {
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Middleware, sameOrigin)
+
+			r.With(enabled(cfg.Features.Admin)).Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+				adminT(w, r, &adminView{
+					Entries: library.Entries(),
+					Upload:  uploader != nil,
+				})
+			})
+
+			r.With(enabled(cfg.Features.Admin)).Post("/admin/rescan", func(w http.ResponseWriter, r *http.Request) {
+				if err := library.Rescan(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				redirect(w, r, "admin")
+			})
+
+			r.With(enabled(cfg.Features.Admin)).Post("/admin/{respack}/{action:enable|disable}", func(w http.ResponseWriter, r *http.Request) {
+				respackID := chi.URLParam(r, "respack")
+				disable := chi.URLParam(r, "action") == "disable"
+				if err := library.SetDisabled(respackID, disable); err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				redirect(w, r, "admin")
+			})
+
+			if uploader == nil {
+				return
+			}
+
+			renderUpload := func(w http.ResponseWriter, r *http.Request, view *uploadView) {
+				view.Limits = uploader.Limits()
+				view.Rejected, _ = uploader.Rejected(20)
+				uploadT(w, r, view)
+			}
+
+			r.Get("/upload", func(w http.ResponseWriter, r *http.Request) {
+				renderUpload(w, r, &uploadView{})
+			})
+
+			r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+				r.Body = http.MaxBytesReader(w, r.Body, uploader.Limits().MaxSize+1<<20)
+				mr, err := r.MultipartReader()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				for {
+					part, err := mr.NextPart()
+					if err == io.EOF {
+						http.Error(w, "No respack file in upload", http.StatusBadRequest)
+						return
+					} else if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					if part.FormName() != "respack" {
+						continue
+					}
+					respack, err := uploader.Upload(part.FileName(), part)
+					var uploadErr *UploadError
+					if errors.As(err, &uploadErr) {
+						w.WriteHeader(http.StatusUnprocessableEntity)
+						renderUpload(w, r, &uploadView{Report: uploadErr.Report})
+					} else if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						renderUpload(w, r, &uploadView{Error: err.Error()})
+					} else {
+						renderUpload(w, r, &uploadView{Uploaded: respack})
+					}
+					return
+				}
+			})
+		})
+	}
+
+	root := chi.NewRouter()
+	root.Use(requestContext(cfg.Server.trustedProxies))
+	if cfg.Log.Access {
+		root.Use(accessLog)
+	}
+	root.Use(withBase(cfg.BasePath, cfg.Server.ForwardedPrefix), metrics.Middleware, recoverPanics)
+	if cfg.BasePath != "/" {
+		root.Get(strings.TrimSuffix(cfg.BasePath, "/"), func(w http.ResponseWriter, r *http.Request) {
+			redirect(w, r, "")
+		})
+	}
+	root.Mount(cfg.BasePath, r)
+	return root
 }
 
 func filterRespacks(respacks []*Respack, query string) (results []*Respack) {
 	if query == "" {
 		return respacks
 	}
+	tags, query := parseSearchQuery(query)
 	query = strings.ToLower(query)
 outer:
 	for _, rp := range respacks {
+		for _, tag := range tags {
+			if !rp.HasTag(tag) {
+				continue outer
+			}
+		}
+		if query == "" {
+			results = append(results, rp)
+			continue outer
+		}
 		for _, image := range rp.Images.Image {
 			if strings.Contains(strings.ToLower(image.Name), query) ||
 				strings.Contains(strings.ToLower(image.FullName), query) {
@@ -158,35 +733,298 @@ outer:
 	return
 }
 
+// parseSearchQuery splits the tag:name terms from the text of a search.
+// Tags with spaces are quoted, like tag:"Touhou Project".
+func parseSearchQuery(query string) (tags []string, text string) {
+	var words []string
+	for {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+		if rest, ok := strings.CutPrefix(query, "tag:"); ok && strings.HasPrefix(rest, `"`) {
+			if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+				if tag, _ := strconv.Unquote(quoted); tag != "" {
+					tags = append(tags, tag)
+				}
+				query = rest[len(quoted):]
+				continue
+			}
+		}
+		word := query
+		if i := strings.IndexFunc(query, unicode.IsSpace); i >= 0 {
+			word = query[:i]
+		}
+		query = query[len(word):]
+		if tag, ok := strings.CutPrefix(word, "tag:"); ok {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		} else {
+			words = append(words, word)
+		}
+	}
+	return tags, strings.Join(words, " ")
+}
+
+// searchTag returns the search term of a tag.
+func searchTag(tag string) string {
+	if strings.IndexFunc(tag, unicode.IsSpace) >= 0 || strings.HasPrefix(tag, `"`) {
+		return "tag:" + strconv.Quote(tag)
+	}
+	return "tag:" + tag
+}
+
 type respacksView struct {
-	Search   string
-	Respacks []*Respack
+	Path        string
+	Collection  string
+	Search      string
+	Sort        string
+	DefaultSort string
+	Tags        []string
+	ActiveTags  []string
+	Respacks    []*Respack
+	Links       bool // whether mixes can be saved as short links
+
+	sorts map[string]func([]*Respack)
 }
 
-type huesConfig struct {
-	Respacks    []string `json:"respack"`
-	DefaultSong int      `json:"defaultSong"`
-	AutoPlay    bool     `json:"autoPlay"`
+func newRespacksView(path, collection string, query url.Values, respacks []*Respack, sorts map[string]func([]*Respack), defaultSort string) (*respacksView, error) {
+	search := query.Get("search")
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = defaultSort
+	}
+	sortFunc, ok := sorts[sort]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort: %s", sort)
+	}
+	activeTags, _ := parseSearchQuery(search)
+	view := &respacksView{
+		Path:        path,
+		Collection:  collection,
+		Search:      search,
+		Sort:        sort,
+		DefaultSort: defaultSort,
+		Tags:        listTags(respacks),
+		ActiveTags:  activeTags,
+		Respacks:    filterRespacks(respacks, search),
+		sorts:       sorts,
+	}
+	sortFunc(view.Respacks)
+	return view, nil
 }
 
-type tmplView struct {
-	Title string
-	Base  string
-	Data  any
+func (v *respacksView) url(search, sort string) string {
+	query := make(url.Values)
+	if search != "" {
+		query.Set("search", search)
+	}
+	if sort != v.DefaultSort {
+		query.Set("sort", sort)
+	}
+	if len(query) == 0 {
+		return v.Path + "?"
+	}
+	return v.Path + "?" + query.Encode()
 }
 
-func getView(r *http.Request, title string, data any) *tmplView {
-	view := &tmplView{
-		Title: title,
-		Base:  "/",
-		Data:  data,
+func (v *respacksView) Sorts() []string {
+	sorts := make([]string, 0, len(v.sorts))
+	for name := range v.sorts {
+		sorts = append(sorts, name)
+	}
+	sort.Strings(sorts)
+	return sorts
+}
+
+func (v *respacksView) SortURL(sort string) string {
+	return v.url(v.Search, sort)
+}
+
+func (v *respacksView) IsActiveTag(tag string) bool {
+	return containsFold(v.ActiveTags, tag)
+}
+
+func (v *respacksView) TagURL(tag string) string {
+	return v.url(v.toggleTag(tag), v.Sort)
+}
+
+func (v *respacksView) toggleTag(tag string) string {
+	tags, text := parseSearchQuery(v.Search)
+	var words []string
+	if text != "" {
+		words = append(words, text)
+	}
+	for _, t := range tags {
+		if !strings.EqualFold(t, tag) {
+			words = append(words, searchTag(t))
+		}
+	}
+	if !v.IsActiveTag(tag) {
+		words = append(words, searchTag(tag))
+	}
+	return strings.Join(words, " ")
+}
+
+// statsView is the stats summary with the names of the respacks.
+type statsView struct {
+	Days     int
+	Launches []*playedItem
+	Respacks []*playedItem
+	Songs    []*playedItem
+}
+
+type playedItem struct {
+	Name  string
+	Path  string // player path relative to the base path, empty if gone
+	Count int
+}
+
+func newStatsView(summary *StatsSummary, getRespack func(string) (*Respack, bool)) *statsView {
+	respackName := func(id string) (string, bool) {
+		if respack, ok := getRespack(id); ok {
+			return respack.Name(), true
+		}
+		return id, false
 	}
-	if slashes := strings.Count(r.URL.Path, "/"); slashes > 1 {
-		view.Base = strings.Repeat("../", slashes-1)
+	view := &statsView{Days: summary.Days}
+	for _, launch := range summary.Launches {
+		item := &playedItem{Path: launch.Key + "/", Count: launch.Count}
+		var names []string
+		for _, id := range strings.Split(launch.Key, ",") {
+			name, ok := respackName(id)
+			if !ok {
+				item.Path = ""
+			}
+			names = append(names, name)
+		}
+		item.Name = strings.Join(names, " + ")
+		view.Launches = append(view.Launches, item)
+	}
+	for _, respack := range summary.Respacks {
+		item := &playedItem{Path: respack.Key + "/", Count: respack.Count}
+		var ok bool
+		if item.Name, ok = respackName(respack.Key); !ok {
+			item.Path = ""
+		}
+		view.Respacks = append(view.Respacks, item)
+	}
+	for _, song := range summary.Songs {
+		respackID, name, _ := strings.Cut(song.Key, "/")
+		item := &playedItem{Name: name, Count: song.Count}
+		if respackName, ok := respackName(respackID); ok {
+			item.Name += " (" + respackName + ")"
+			item.Path = respackID + "/?song=" + url.QueryEscape(name)
+		}
+		view.Songs = append(view.Songs, item)
 	}
 	return view
 }
 
+type adminView struct {
+	Entries []*LibraryEntry
+	Upload  bool
+}
+
+type uploadView struct {
+	Limits   UploadLimits
+	Uploaded *Respack
+	Error    string
+	Report   *UploadReport
+	Rejected []*UploadReport
+}
+
+type tmplView struct {
+	Title   string
+	Base    string
+	URL     string // absolute URL of the page
+	BaseURL string // absolute URL of the base path
+	Data    any
+}
+
+func cacheControl(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxAge > 0 {
+				w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// enabled responds with 404 to requests of disabled features.
+func enabled(feature bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if feature {
+			return next
+		}
+		return http.NotFoundHandler()
+	}
+}
+
+type contextKey int
+
+const (
+	baseContextKey contextKey = iota
+	prefixContextKey
+	requestIDContextKey
+	clientIPContextKey
+	schemeContextKey
+)
+
+// withBase stores the absolute path the app is served under in the request
+// context. A reverse proxy that strips a prefix can pass it in the
+// X-Forwarded-Prefix header.
+func withBase(basePath string, forwardedPrefix bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var prefix string
+			if header := r.Header.Get("X-Forwarded-Prefix"); forwardedPrefix && header != "" {
+				prefix = strings.TrimSuffix(path.Clean("/"+header), "/")
+			}
+			ctx := context.WithValue(r.Context(), baseContextKey, prefix+basePath)
+			ctx = context.WithValue(ctx, prefixContextKey, prefix)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestBase returns the absolute base path of the app, ending with a slash.
+func requestBase(r *http.Request) string {
+	if base, ok := r.Context().Value(baseContextKey).(string); ok {
+		return base
+	}
+	return "/"
+}
+
+// requestURL returns the absolute URL of the request as seen by the client.
+func requestURL(r *http.Request) string {
+	prefix, _ := r.Context().Value(prefixContextKey).(string)
+	return requestScheme(r) + "://" + r.Host + prefix + r.URL.RequestURI()
+}
+
+// absoluteURL returns the absolute URL of a path relative to the base path.
+func absoluteURL(r *http.Request, path string) string {
+	return requestScheme(r) + "://" + r.Host + requestBase(r) + path
+}
+
+// redirect redirects to a path relative to the base path of the app.
+func redirect(w http.ResponseWriter, r *http.Request, path string) {
+	http.Redirect(w, r, requestBase(r)+path, http.StatusSeeOther)
+}
+
+func getView(r *http.Request, title string, data any) *tmplView {
+	return &tmplView{
+		Title:   title,
+		Base:    requestBase(r),
+		URL:     requestURL(r),
+		BaseURL: absoluteURL(r, ""),
+		Data:    data,
+	}
+}
+
 func loadTemplate(title string, filenames ...string) (func(w http.ResponseWriter, r *http.Request, data any), error) {
 	t := template.New("").Funcs(templateFuncs)
 	for _, filename := range filenames {
@@ -200,11 +1038,14 @@ func loadTemplate(title string, filenames ...string) (func(w http.ResponseWriter
 		}
 	}
 	return func(w http.ResponseWriter, r *http.Request, data any) {
+		var err error
 		if r.Header.Get("HX-Request") != "" {
-			t.ExecuteTemplate(w, "content", data)
+			err = t.ExecuteTemplate(w, "content", data)
 		} else {
-			view := getView(r, title, data)
-			t.Execute(w, view)
+			err = t.Execute(w, getView(r, title, data))
+		}
+		if err != nil {
+			logRequestError(r, err)
 		}
 	}, nil
 }